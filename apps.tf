@@ -36,6 +36,13 @@ locals {
       base_image            = "cgr.dev/chainguard/static:latest-glibc"
       //alert_id              = module.prober.alert_id
     }
+    "ttl" : {
+      cpu                   = 1
+      ram                   = "512Mi"
+      container_concurrency = 80
+      timeout_seconds       = 900 # 15m
+      base_image            = "cgr.dev/chainguard/static:latest-glibc"
+    }
     wait : {
       cpu                   = 1
       ram                   = "1Gi"
@@ -139,3 +146,69 @@ resource "null_resource" "test" {
 output "cloudrun_url" { value = { for k, _ in local.apps : k => google_cloud_run_service.service[k].status[0].url } }
 output "vanity_url" { value = { for k, _ in local.apps : k => google_cloud_run_domain_mapping.mapping[k].name } }
 
+
+// gc deletes expired cache keys and unreachable blobs from the bucket. It runs
+// as a job on a schedule, rather than as a service.
+resource "ko_build" "gc" {
+  repo       = "gcr.io/${var.project_id}/gc"
+  importpath = "github.com/imjasonh/kontain.me/cmd/gc"
+  base_image = "cgr.dev/chainguard/static:latest-glibc"
+}
+
+resource "google_cloud_run_v2_job" "gc" {
+  name     = "gc"
+  location = var.location
+
+  template {
+    template {
+      service_account = google_service_account.service_account.email
+      timeout         = "3600s" # 1h
+      max_retries     = 1
+      containers {
+        image = ko_build.gc.image_ref
+        env {
+          name  = "BUCKET"
+          value = google_storage_bucket.bucket.name
+        }
+        resources {
+          limits = {
+            cpu    = 1
+            memory = "1Gi"
+          }
+        }
+      }
+    }
+  }
+
+  depends_on = [google_project_service.run-api]
+}
+
+resource "google_cloud_run_v2_job_iam_member" "gc-invoker" {
+  location = var.location
+  name     = google_cloud_run_v2_job.gc.name
+  role     = "roles/run.invoker"
+  member   = "serviceAccount:${google_service_account.service_account.email}"
+}
+
+// Enable Cloud Scheduler API.
+resource "google_project_service" "scheduler-api" {
+  project            = var.project_id
+  service            = "cloudscheduler.googleapis.com"
+  disable_on_destroy = false
+}
+
+resource "google_cloud_scheduler_job" "gc" {
+  name     = "gc"
+  region   = var.location
+  schedule = "0 * * * *" # Hourly.
+
+  http_target {
+    http_method = "POST"
+    uri         = "https://${var.location}-run.googleapis.com/apis/run.googleapis.com/v1/namespaces/${var.project_id}/jobs/${google_cloud_run_v2_job.gc.name}:run"
+    oauth_token {
+      service_account_email = google_service_account.service_account.email
+    }
+  }
+
+  depends_on = [google_project_service.scheduler-api]
+}
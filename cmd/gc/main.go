@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"github.com/kelseyhightower/envconfig"
+)
+
+func main() {
+	ctx := context.Background()
+	var env struct {
+		MaxAge time.Duration `envconfig:"MAX_AGE" default:"24h"`
+		Grace  time.Duration `envconfig:"GRACE" default:"1h"`
+		DryRun bool          `envconfig:"DRY_RUN"`
+	}
+	if err := envconfig.Process("", &env); err != nil {
+		slog.ErrorContext(ctx, "envconfig.Process", "err", err)
+		os.Exit(1)
+	}
+
+	st, err := serve.NewStorage(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "serve.NewStorage", "err", err)
+		os.Exit(1)
+	}
+
+	rep, err := serve.CollectGarbage(ctx, st, serve.GCOptions{
+		MaxAge: env.MaxAge,
+		Grace:  env.Grace,
+		DryRun: env.DryRun,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "serve.CollectGarbage", "err", err)
+		os.Exit(1)
+	}
+	slog.InfoContext(ctx, "collected garbage",
+		"objects", rep.Objects,
+		"manifests", rep.Manifests,
+		"reachable", rep.Reachable,
+		"expired", len(rep.Expired),
+		"deleted", len(rep.Deleted),
+		"skipped", len(rep.Skipped),
+		"bytesFreed", rep.BytesFreed,
+		"dryRun", rep.DryRun)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rep); err != nil {
+		slog.ErrorContext(ctx, "json.Encode", "err", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/chainguard-dev/clog/gcp"
+	"github.com/imjasonh/kontain.me/pkg/apko"
+	"github.com/imjasonh/kontain.me/pkg/flatten"
+	"github.com/imjasonh/kontain.me/pkg/ko"
+	"github.com/imjasonh/kontain.me/pkg/mirror"
+	"github.com/imjasonh/kontain.me/pkg/random"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"github.com/imjasonh/kontain.me/pkg/ttl"
+	"github.com/imjasonh/kontain.me/pkg/viz"
+	"github.com/imjasonh/kontain.me/pkg/wait"
+)
+
+func main() {
+	ctx := context.Background()
+	st, err := serve.NewStorage(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "serve.NewStorage", "err", err)
+		os.Exit(1)
+	}
+	// If credentials are configured, check they're complete before serving
+	// any requests.
+	if _, err := serve.NewAuth(); err != nil {
+		slog.ErrorContext(ctx, "serve.NewAuth", "err", err)
+		os.Exit(1)
+	}
+	// If $SIGNING_KEY is set, built images are signed with that key.
+	signer, err := serve.NewImageSigner()
+	if err != nil {
+		slog.ErrorContext(ctx, "serve.NewImageSigner", "err", err)
+		os.Exit(1)
+	}
+	// If $MAX_TTL is set, it limits how long images pushed to ttl are kept.
+	maxTTL, err := ttl.MaxTTL()
+	if err != nil {
+		slog.ErrorContext(ctx, "ttl.MaxTTL", "err", err)
+		os.Exit(1)
+	}
+	// Run tasks enqueued by asynchronous builds and waits.
+	serve.InitTasks()
+	http.Handle("/", gcp.WithCloudTraceContext(&router{
+		services: map[string]http.Handler{
+			"random":  random.New(st),
+			"wait":    wait.New(st),
+			"mirror":  mirror.New(st),
+			"flatten": flatten.New(st, signer),
+			"ko":      ko.New(st, signer),
+			"apko":    apko.New(st, signer),
+			"ttl":     ttl.New(st, maxTTL),
+			"viz":     viz.New(),
+		},
+		// Requests that aren't for any one service, like /v2/, /token,
+		// /logs/ and /catalog, are served from the shared storage.
+		root: &serve.Router{
+			Storage:  st,
+			Signer:   signer,
+			Fallback: http.RedirectHandler("https://github.com/imjasonh/kontain.me", http.StatusSeeOther),
+		},
+	}))
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+		slog.InfoContext(ctx, "Defaulting port", "port", port)
+	}
+	slog.InfoContext(ctx, "Listening...", "port", port)
+	slog.ErrorContext(ctx, "ListenAndServe", "err", http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+}
+
+// router routes requests to services by the first label of the Host header,
+// like random.localhost:8080, or else by the first component of the
+// repository, like localhost:8080/v2/random/...
+type router struct {
+	services map[string]http.Handler
+	root     http.Handler
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if label, _, ok := strings.Cut(r.Host, "."); ok {
+		if h, ok := rt.services[label]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/v2/"); ok {
+		name, rest, _ := strings.Cut(rest, "/")
+		if h, ok := rt.services[name]; ok {
+			// Serve /v2/random/foo/manifests/latest as
+			// /v2/foo/manifests/latest.
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = "/v2/" + rest
+			r2.URL.RawPath = ""
+			h.ServeHTTP(w, r2)
+			return
+		}
+		if name != "" && name != "_catalog" {
+			serve.Error(w, serve.Errorf(serve.NameUnknown, "unknown service %q", name))
+			return
+		}
+	}
+	rt.root.ServeHTTP(w, r)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/chainguard-dev/clog/gcp"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"github.com/imjasonh/kontain.me/pkg/ttl"
+)
+
+func main() {
+	ctx := context.Background()
+	st, err := serve.NewStorage(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "serve.NewStorage", "err", err)
+		os.Exit(1)
+	}
+	// If credentials are configured, check they're complete before serving
+	// any requests.
+	if _, err := serve.NewAuth(); err != nil {
+		slog.ErrorContext(ctx, "serve.NewAuth", "err", err)
+		os.Exit(1)
+	}
+	maxTTL, err := ttl.MaxTTL()
+	if err != nil {
+		slog.ErrorContext(ctx, "ttl.MaxTTL", "err", err)
+		os.Exit(1)
+	}
+	http.Handle("/", gcp.WithCloudTraceContext(ttl.New(st, maxTTL)))
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+		slog.InfoContext(ctx, "Defaulting port", "port", port)
+	}
+	slog.InfoContext(ctx, "Listening...", "port", port)
+	slog.ErrorContext(ctx, "ListenAndServe", "err", http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+}
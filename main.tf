@@ -54,15 +54,8 @@ resource "google_storage_bucket" "bucket" {
 
   uniform_bucket_level_access = true
 
-  # Delete objects after 1 day.
-  lifecycle_rule {
-    condition {
-      age = 1
-    }
-    action {
-      type = "Delete"
-    }
-  }
+  # Objects are deleted by the gc job in apps.tf, rather than a lifecycle
+  # rule, since blobs shared by newer images must outlive their first write.
 
   # Allow
   cors {
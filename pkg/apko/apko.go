@@ -0,0 +1,283 @@
+package apko
+
+import (
+	"context"
+	"crypto"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"chainguard.dev/apko/pkg/apk/fs"
+	"chainguard.dev/apko/pkg/build"
+	"chainguard.dev/apko/pkg/build/types"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"gopkg.in/yaml.v2"
+)
+
+// New returns a registry that serves base images built by apko from the
+// requested packages, caching them in st. If signer is non-nil, built images
+// are signed with it.
+//
+// If $ASYNC_BUILDS is true, manifest misses start a build in the background
+// and tell the client to retry later.
+func New(st serve.Storage, signer crypto.Signer) http.Handler {
+	async, _ := strconv.ParseBool(os.Getenv("ASYNC_BUILDS"))
+	s := &server{storage: st, async: async, signer: signer}
+	if async {
+		serve.RegisterAsyncBuild(service, st, s.buildArgs)
+	}
+	return &serve.Router{
+		Storage:         st,
+		Service:         service,
+		ResolveManifest: s.resolveManifest,
+		ListTags:        s.listTags,
+		Signer:          signer,
+		Fallback:        http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/apko", http.StatusSeeOther),
+	}
+}
+
+// service labels metrics recorded by this service.
+const service = "apko"
+
+// builderID and buildType identify builds by this service in provenance.
+const (
+	builderID = "https://github.com/imjasonh/kontain.me/tree/main/cmd/apko"
+	buildType = "https://github.com/imjasonh/kontain.me/blob/main/cmd/apko/README.md#provenance"
+)
+
+type server struct {
+	storage serve.Storage
+	async   bool
+	signer  crypto.Signer
+}
+
+// runBuild builds the image for the cache key from args, unless another
+// request is already doing so. Asynchronous builds run in a task, so
+// everything the build needs is passed in args.
+func (s *server) runBuild(ctx context.Context, ck string, args ...string) error {
+	if s.async {
+		return serve.BuildAsync(ctx, s.storage, service, ck, args...)
+	}
+	return serve.Build(ctx, s.storage, ck, func(ctx context.Context) error {
+		return s.buildArgs(ctx, ck, args)
+	})
+}
+
+// apko.kontain.me/wolfi-baselayout/nginx -> apko build and serve
+func (s *server) resolveManifest(ctx context.Context, repo, tag string) (string, error) {
+	packages, _, _, err := imageConfig(ctx, repo)
+	if err != nil {
+		return "", err
+	}
+	ck := cacheKey(packages)
+
+	// Check if we've already got a manifest for this set of packages.
+	if err := serve.VerifyManifest(ctx, s.storage, ck); err == nil {
+		serve.RecordCacheLookup(service, true)
+		slog.InfoContext(ctx, "serving cached manifest", "ck", ck)
+		s.recordTag(ctx, repo, tag)
+		return ck, nil
+	}
+	serve.RecordCacheLookup(service, false)
+
+	// Build the image, unless another request is already doing so.
+	if err := s.runBuild(ctx, ck, repo); err != nil {
+		return "", err
+	}
+	s.recordTag(ctx, repo, tag)
+	return ck, nil
+}
+
+// imageConfig returns the packages named by the repo, and the image
+// configuration to build them with along with the inputs it was made from.
+// If the repo is url/<url>, the configuration is fetched from the URL.
+func imageConfig(ctx context.Context, repo string) ([]string, types.ImageConfiguration, map[string]any, error) {
+	packages := strings.Split(repo, "/")
+	var ic types.ImageConfiguration
+	var inputs map[string]any
+	if packages[0] == "url" {
+		url := "https://" + strings.Join(packages[1:], "/")
+		inputs = map[string]any{"config": url}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, ic, nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, ic, nil, fmt.Errorf("http.Get: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, ic, nil, serve.Errorf(serve.NameUnknown, "fetching config: %s", resp.Status)
+		}
+
+		if err := yaml.NewDecoder(resp.Body).Decode(&ic); err != nil {
+			return nil, ic, nil, serve.Errorf(serve.ManifestInvalid, "yaml.Decode: %w", err)
+		}
+		return packages, ic, inputs, nil
+	}
+
+	sort.Strings(packages)
+	inputs = map[string]any{"packages": packages}
+
+	// TODO: no way to actually specify an ImageConfiguration... :-/
+	if err := yaml.NewDecoder(strings.NewReader(fmt.Sprintf(`
+contents:
+  repositories:
+  - https://packages.wolfi.dev/os
+  keyring:
+  - https://packages.wolfi.dev/os/wolfi-signing.rsa.pub
+  packages: [%s]
+`, strings.Join(packages, ",")))).Decode(&ic); err != nil {
+		return nil, ic, nil, fmt.Errorf("yaml.Decode: %w", err)
+	}
+	return packages, ic, inputs, nil
+}
+
+// buildArgs builds the image for the cache key from the repo requested, and
+// writes it.
+func (s *server) buildArgs(ctx context.Context, ck string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("got %d build args, want 1", len(args))
+	}
+	repo := args[0]
+	_, ic, inputs, err := imageConfig(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	serve.ReportProgress(ctx, "building image")
+	started := time.Now()
+	img, pkgs, err := s.build(ctx, ic)
+	if err != nil {
+		return fmt.Errorf("build: %w", err)
+	}
+	if err := serve.SignImage(ctx, s.storage, s.signer, repo, img); err != nil {
+		return fmt.Errorf("serve.SignImage: %w", err)
+	}
+	if err := serve.AttestProvenance(ctx, s.storage, s.signer, repo, img, serve.Provenance{
+		BuilderID:            builderID,
+		BuildType:            buildType,
+		ExternalParameters:   map[string]any{"imageConfiguration": ic},
+		InternalParameters:   map[string]string{"arch": amd64.String()},
+		ResolvedDependencies: pkgs,
+		InvocationID:         ck,
+		Started:              started,
+		Finished:             time.Now(),
+	}); err != nil {
+		return fmt.Errorf("serve.AttestProvenance: %w", err)
+	}
+	serve.ReportProgress(ctx, "writing image")
+	done := serve.TimePhase(service, "write")
+	err = serve.WriteImage(ctx, s.storage, img, ck)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("serve.WriteImage: %w", err)
+	}
+	if err := serve.RecordBuild(ctx, s.storage, service, ck, repo, inputs, img); err != nil {
+		slog.WarnContext(ctx, "serve.RecordBuild", "ck", ck, "err", err)
+	}
+	return nil
+}
+
+// listTags lists the tags that have been pulled from the repository and
+// are still cached.
+func (s *server) listTags(ctx context.Context, repo string) ([]string, error) {
+	return serve.RecordedTags(ctx, s.storage, service, repo)
+}
+
+// recordTag records that the tag was served, so it's listed by listTags.
+// Failing to record it doesn't fail the pull.
+func (s *server) recordTag(ctx context.Context, repo, tag string) {
+	if err := serve.RecordTag(ctx, s.storage, service, repo, tag, time.Time{}); err != nil {
+		slog.WarnContext(ctx, "serve.RecordTag", "repo", repo, "tag", tag, "err", err)
+	}
+}
+
+var amd64 = types.ParseArchitecture("amd64")
+
+// build builds the image, and returns it along with the packages installed
+// in it.
+func (s *server) build(ctx context.Context, ic types.ImageConfiguration) (v1.Image, []serve.ResourceDescriptor, error) {
+	wd, err := os.MkdirTemp("", "apko-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create working directory: %w", err)
+	}
+	defer os.RemoveAll(wd)
+
+	bc, err := build.New(ctx, fs.DirFS(wd),
+		build.WithImageConfiguration(ic),
+		build.WithArch(amd64), // TODO: multiarch
+		build.WithBuildDate(time.Time{}.Format(time.RFC3339)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	done := serve.TimePhase(service, "buildLayer")
+	_, layer, err := bc.BuildLayer(ctx)
+	done(err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build layer image for %q: %w", amd64, err)
+	}
+	installed, err := bc.InstalledPackages()
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing installed packages: %w", err)
+	}
+	pkgs := make([]serve.ResourceDescriptor, 0, len(installed))
+	for _, p := range installed {
+		pkgs = append(pkgs, serve.ResourceDescriptor{
+			URI:    fmt.Sprintf("pkg:apk/%s@%s?arch=%s", p.Name, p.Version, p.Arch),
+			Name:   p.Name,
+			Digest: map[string]string{"sha1": hex.EncodeToString(p.Checksum)},
+		})
+	}
+
+	adds := make([]mutate.Addendum, 0, 1)
+	adds = append(adds, mutate.Addendum{
+		Layer: layer,
+		History: v1.History{
+			Author:    "apko",
+			Comment:   "This is an apko single-layer image",
+			CreatedBy: "apko",
+			Created:   v1.Time{Time: time.Time{}},
+		},
+	})
+
+	v1Image, err := mutate.Append(empty.Image, adds...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to append OCI layer to empty image: %w", err)
+	}
+
+	cfg, err := v1Image.ConfigFile()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get OCI config file: %w", err)
+	}
+
+	cfg = cfg.DeepCopy()
+	cfg.Author = "apko.kontain.me"
+	cfg.Architecture = "amd64" // TODO: multiarch
+	cfg.OS = "linux"
+	cfg.Config.Entrypoint = []string{"/bin/sh", "-l"}
+
+	img, err := mutate.ConfigFile(v1Image, cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to update OCI config file: %w", err)
+	}
+
+	return img, pkgs, nil
+}
+
+func cacheKey(packages []string) string {
+	ck := []byte(strings.Join(packages, ","))
+	return fmt.Sprintf("apko-%x", md5.Sum(ck))
+}
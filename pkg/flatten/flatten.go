@@ -0,0 +1,294 @@
+package flatten
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"golang.org/x/sync/errgroup"
+)
+
+// New returns a registry that serves flattened images pulled from other
+// registries, caching them in st. If signer is non-nil, flattened images are
+// signed with it. Images are pulled from upstream with opts, like
+// remote.WithTransport.
+func New(st serve.Storage, signer crypto.Signer, opts ...remote.Option) http.Handler {
+	s := &server{storage: st, signer: signer, opts: opts}
+	return &serve.Router{
+		Storage:         st,
+		Service:         service,
+		ResolveManifest: s.resolveManifest,
+		ListTags:        s.listTags,
+		Signer:          signer,
+		Fallback:        http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/flatten", http.StatusSeeOther),
+	}
+}
+
+// service labels metrics recorded by this service.
+const service = "flatten"
+
+type server struct {
+	storage serve.Storage
+	signer  crypto.Signer
+	opts    []remote.Option
+}
+
+// remoteOptions returns the options for requests to upstream registries made
+// while serving ctx.
+func (s *server) remoteOptions(ctx context.Context) []remote.Option {
+	return append(slices.Clip(s.opts), remote.WithContext(ctx))
+}
+
+var acceptableMediaTypes = map[types.MediaType]bool{
+	types.DockerManifestSchema2: true,
+	types.DockerManifestList:    true,
+	types.OCIImageIndex:         true,
+	types.OCIManifestSchema1:    true,
+}
+
+func cacheKey(orig string) string { return fmt.Sprintf("flatten-%s", orig) }
+
+// flatten.kontain.me/ubuntu -> flatten ubuntu and serve
+func (s *server) resolveManifest(ctx context.Context, repo, tag string) (string, error) {
+	refstr := repo + ":" + tag
+	for strings.HasPrefix(refstr, "flatten.kontain.me/") {
+		refstr = strings.TrimPrefix(refstr, "flatten.kontain.me/")
+	}
+
+	ref, err := name.ParseReference(refstr)
+	if err != nil {
+		return "", serve.Errorf(serve.NameInvalid, "name.ParseReference: %w", err)
+	}
+
+	var idx v1.ImageIndex
+	var img v1.Image
+	var ck string
+
+	// Determine whether the ref is for an image or index.
+	d, err := remote.Head(ref, s.remoteOptions(ctx)...)
+	if err != nil {
+		slog.ErrorContext(ctx, "remote.Head", "ref", refstr, "err", err)
+		var h v1.Hash
+		// HEAD failed, let's figure out if it was an index or image by doing GETs.
+		idx, err = remote.Index(ref, s.remoteOptions(ctx)...)
+		if err != nil {
+			slog.ErrorContext(ctx, "remote.Index", "ref", refstr, "err", err)
+			img, err = remote.Image(ref, s.remoteOptions(ctx)...)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if idx != nil {
+			h, err = idx.Digest()
+		} else if img != nil {
+			h, err = img.Digest()
+		}
+		if err != nil {
+			return "", fmt.Errorf("Digest(): %w", err)
+		}
+
+		// Check if we have a flattened manifest cached (since HEAD failed
+		// before), and if so serve it directly.
+		ck = cacheKey(h.String())
+		if err := serve.VerifyManifest(ctx, s.storage, ck); err == nil {
+			serve.RecordCacheLookup(service, true)
+			slog.InfoContext(ctx, "serving cached manifest", "ck", ck)
+			s.recordTag(ctx, repo, tag)
+			return ck, nil
+		}
+		serve.RecordCacheLookup(service, false)
+	} else {
+		if !acceptableMediaTypes[d.MediaType] {
+			return "", serve.Errorf(serve.ManifestInvalid, "unknown media type: %s", d.MediaType)
+		}
+
+		// Check if we have a flattened manifest cached, and if so serve it
+		// directly.
+		ck = cacheKey(d.Digest.String())
+		if err := serve.VerifyManifest(ctx, s.storage, ck); err == nil {
+			serve.RecordCacheLookup(service, true)
+			slog.InfoContext(ctx, "serving cached manifest", "ck", ck)
+			s.recordTag(ctx, repo, tag)
+			return ck, nil
+		}
+		serve.RecordCacheLookup(service, false)
+
+		switch d.MediaType {
+		case types.OCIImageIndex, types.DockerManifestList:
+			idx, err = remote.Index(ref, s.remoteOptions(ctx)...)
+			if err != nil {
+				return "", err
+			}
+		case types.OCIManifestSchema1, types.DockerManifestSchema2:
+			img, err = remote.Image(ref, s.remoteOptions(ctx)...)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// Flatten the image, unless another request is already doing so.
+	if err := serve.Build(ctx, s.storage, ck, func(ctx context.Context) error {
+		if idx != nil {
+			done := serve.TimePhase(service, "flatten")
+			fidx, err := s.flattenIndex(ctx, idx)
+			done(err)
+			if err != nil {
+				return err
+			}
+			if err := serve.SignImage(ctx, s.storage, s.signer, repo, fidx); err != nil {
+				return fmt.Errorf("serve.SignImage: %w", err)
+			}
+			done = serve.TimePhase(service, "write")
+			err = serve.WriteIndex(ctx, s.storage, fidx, ck)
+			done(err)
+			if err != nil {
+				return fmt.Errorf("serve.WriteIndex: %w", err)
+			}
+			s.recordBuild(ctx, ck, repo, refstr, fidx)
+			return nil
+		}
+
+		done := serve.TimePhase(service, "flatten")
+		fimg, err := s.flatten(ctx, img)
+		if err == nil {
+			// Flattened layers are computed lazily; compute the
+			// digest now so the time is attributed to flattening
+			// rather than writing.
+			_, err = fimg.Digest()
+		}
+		done(err)
+		if err != nil {
+			return err
+		}
+		if err := serve.SignImage(ctx, s.storage, s.signer, repo, fimg); err != nil {
+			return fmt.Errorf("serve.SignImage: %w", err)
+		}
+		done = serve.TimePhase(service, "write")
+		err = serve.WriteImage(ctx, s.storage, fimg, ck)
+		done(err)
+		if err != nil {
+			return fmt.Errorf("serve.WriteImage: %w", err)
+		}
+		s.recordBuild(ctx, ck, repo, refstr, fimg)
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	s.recordTag(ctx, repo, tag)
+	return ck, nil
+}
+
+// recordBuild records the flattened image in the catalog, along with the
+// reference it was flattened from. Failing to record it doesn't fail the
+// build.
+func (s *server) recordBuild(ctx context.Context, ck, repo, ref string, d partial.Describable) {
+	if err := serve.RecordBuild(ctx, s.storage, service, ck, repo, map[string]any{
+		"ref":    ref,
+		"digest": strings.TrimPrefix(ck, "flatten-"),
+	}, d); err != nil {
+		slog.WarnContext(ctx, "serve.RecordBuild", "ck", ck, "err", err)
+	}
+}
+
+// listTags lists the tags that have been pulled from the repository and
+// are still cached.
+func (s *server) listTags(ctx context.Context, repo string) ([]string, error) {
+	return serve.RecordedTags(ctx, s.storage, service, repo)
+}
+
+// recordTag records that the tag was served, so it's listed by listTags.
+// Failing to record it doesn't fail the pull.
+func (s *server) recordTag(ctx context.Context, repo, tag string) {
+	if err := serve.RecordTag(ctx, s.storage, service, repo, tag, time.Time{}); err != nil {
+		slog.WarnContext(ctx, "serve.RecordTag", "repo", repo, "tag", tag, "err", err)
+	}
+}
+
+func (s *server) flattenIndex(ctx context.Context, idx v1.ImageIndex) (v1.ImageIndex, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		slog.ErrorContext(ctx, "idx.IndexManifest", "err", err)
+		return nil, err
+	}
+	// Flatten each image in the manifest.
+	var g errgroup.Group
+	adds := make([]mutate.IndexAddendum, len(im.Manifests))
+	for i, m := range im.Manifests {
+		i, m := i, m
+		g.Go(func() error {
+			img, err := idx.Image(m.Digest)
+			if err != nil {
+				slog.ErrorContext(ctx, "idx.Image", "err", err)
+				return err
+			}
+			fimg, err := s.flatten(ctx, img)
+			if err != nil {
+				return err
+			}
+			m.Digest, err = fimg.Digest()
+			if err != nil {
+				slog.ErrorContext(ctx, "fimg.Digest", "err", err)
+				return err
+			}
+			adds[i] = mutate.IndexAddendum{
+				Add:        fimg,
+				Descriptor: m,
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		slog.ErrorContext(ctx, "g.Wait", "err", err)
+		return nil, err
+	}
+	return mutate.AppendManifests(empty.Index, adds...), nil
+}
+
+func (s *server) flatten(ctx context.Context, img v1.Image) (v1.Image, error) {
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) { return mutate.Extract(img), nil })
+	if err != nil {
+		slog.ErrorContext(ctx, "tarball.LayerFromOpener", "err", err)
+		return nil, err
+	}
+	fimg, err := mutate.AppendLayers(empty.Image, l)
+	if err != nil {
+		slog.ErrorContext(ctx, "mutate.AppendLayers", "err", err)
+		return nil, err
+	}
+
+	// Copy over basic information from original config file.
+	ocf, err := img.ConfigFile()
+	if err != nil {
+		slog.ErrorContext(ctx, "img.ConfigFile", "err", err)
+		return nil, err
+	}
+	ncf, err := fimg.ConfigFile()
+	if err != nil {
+		slog.ErrorContext(ctx, "fimg.ConfigFile", "err", err)
+		return nil, err
+	}
+	cf := ncf.DeepCopy()
+	cf.Architecture = ocf.Architecture
+	cf.OS = ocf.OS
+	cf.OSVersion = ocf.OSVersion
+	cf.Config = ocf.Config
+
+	return mutate.ConfigFile(fimg, cf)
+}
@@ -0,0 +1,143 @@
+package flatten
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"github.com/imjasonh/kontain.me/pkg/serve/servetest"
+)
+
+// checkFlat checks that the image is valid and has a single layer.
+func checkFlat(t *testing.T, img v1.Image) {
+	t.Helper()
+	if err := validate.Image(img); err != nil {
+		t.Errorf("validate.Image: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 {
+		t.Errorf("got %d layers, want 1", len(layers))
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	t.Parallel()
+	tr := servetest.Upstream(t)
+	upstream := remote.WithTransport(tr)
+	host := servetest.Serve(t, New(serve.NewMemoryStorage(), nil, upstream))
+
+	img, err := random.Image(1000, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(name.MustParseReference(servetest.UpstreamHost+"/test/image:latest"), img, upstream); err != nil {
+		t.Fatalf("remote.Write: %v", err)
+	}
+	idx, err := random.Index(1000, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(name.MustParseReference(servetest.UpstreamHost+"/test/index:latest"), idx, upstream); err != nil {
+		t.Fatalf("remote.WriteIndex: %v", err)
+	}
+
+	// Images are flattened by tag.
+	repo, err := name.NewRepository(host + "/" + servetest.UpstreamHost + "/test/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat, err := remote.Image(repo.Tag("latest"))
+	if err != nil {
+		t.Fatalf("remote.Image: %v", err)
+	}
+	checkFlat(t, flat)
+	d, err := flat.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The flattened image is served by digest, and is what HEAD describes.
+	for _, ref := range []name.Reference{repo.Tag("latest"), repo.Digest(d.String())} {
+		desc, err := remote.Head(ref)
+		if err != nil {
+			t.Fatalf("remote.Head(%s): %v", ref, err)
+		}
+		if desc.Digest != d {
+			t.Errorf("HEAD %s got digest %s, want %s", ref, desc.Digest, d)
+		}
+	}
+	byDigest, err := remote.Image(repo.Digest(d.String()))
+	if err != nil {
+		t.Fatalf("remote.Image: %v", err)
+	}
+	checkFlat(t, byDigest)
+
+	// Once flattened, images are served from storage, even if their blobs
+	// are gone upstream.
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ld, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	servetest.DeleteUpstreamBlob(t, tr, "test/image", ld)
+	cached, err := remote.Image(repo.Tag("latest"))
+	if err != nil {
+		t.Fatalf("remote.Image: %v", err)
+	}
+	checkFlat(t, cached)
+	if cd, err := cached.Digest(); err != nil {
+		t.Fatal(err)
+	} else if cd != d {
+		t.Errorf("cached image got digest %s, want %s", cd, d)
+	}
+
+	// Each image in an index is flattened.
+	ref := repo.Registry.Repo(servetest.UpstreamHost, "test", "index").Tag("latest")
+	flatIdx, err := remote.Index(ref)
+	if err != nil {
+		t.Fatalf("remote.Index(%s): %v", ref, err)
+	}
+	if err := validate.Index(flatIdx); err != nil {
+		t.Errorf("validate.Index(%s): %v", ref, err)
+	}
+	im, err := flatIdx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(im.Manifests) != 2 {
+		t.Errorf("got %d manifests, want 2", len(im.Manifests))
+	}
+	for _, desc := range im.Manifests {
+		child, err := flatIdx.Image(desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFlat(t, child)
+	}
+
+	// Errors from upstream are passed on to clients.
+	missing := repo.Tag("missing")
+	if _, err := remote.Image(missing); servetest.ErrorCode(err) != "MANIFEST_UNKNOWN" {
+		t.Errorf("remote.Image(%s): got %v, want MANIFEST_UNKNOWN", missing, err)
+	}
+
+	// Tags that have been flattened are listed.
+	tags, err := remote.List(repo)
+	if err != nil {
+		t.Fatalf("remote.List: %v", err)
+	}
+	if want := []string{"latest"}; !slices.Equal(tags, want) {
+		t.Errorf("remote.List: got %v, want %v", tags, want)
+	}
+}
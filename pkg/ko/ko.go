@@ -0,0 +1,473 @@
+package ko
+
+import (
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/ko/pkg/build"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"github.com/sigstore/cosign/v2/pkg/oci"
+	"github.com/sigstore/cosign/v2/pkg/oci/walk"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/mod/zip"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// New returns a registry that serves images built from Go import paths by ko,
+// caching them in st. If signer is non-nil, built images are signed with it.
+//
+// If $ASYNC_BUILDS is true, manifest misses start a build in the background
+// and tell the client to retry later. If $DISABLE_SBOM is true, images are
+// built without SBOMs.
+func New(st serve.Storage, signer crypto.Signer) http.Handler {
+	async, _ := strconv.ParseBool(os.Getenv("ASYNC_BUILDS"))
+	disableSBOM, _ := strconv.ParseBool(os.Getenv("DISABLE_SBOM"))
+	s := &server{storage: st, async: async, signer: signer, disableSBOM: disableSBOM}
+	if async {
+		serve.RegisterAsyncBuild(service, st, s.build)
+	}
+	return &serve.Router{
+		Storage:         st,
+		Service:         service,
+		ResolveManifest: s.resolveManifest,
+		ListTags:        s.listTags,
+		Signer:          signer,
+		Fallback:        http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/ko", http.StatusSeeOther),
+	}
+}
+
+// service labels metrics recorded by this service.
+const service = "ko"
+
+// builderID and buildType identify builds by this service in provenance.
+const (
+	builderID = "https://github.com/imjasonh/kontain.me/tree/main/cmd/ko"
+	buildType = "https://github.com/imjasonh/kontain.me/blob/main/cmd/ko/README.md#provenance"
+)
+
+type server struct {
+	storage     serve.Storage
+	async       bool
+	signer      crypto.Signer
+	disableSBOM bool
+}
+
+// runBuild builds the image for the cache key from args, unless another
+// request is already doing so. Asynchronous builds run in a task, so
+// everything the build needs is passed in args.
+func (s *server) runBuild(ctx context.Context, ck string, args ...string) error {
+	if s.async {
+		return serve.BuildAsync(ctx, s.storage, service, ck, args...)
+	}
+	return serve.Build(ctx, s.storage, ck, func(ctx context.Context) error {
+		return s.build(ctx, ck, args)
+	})
+}
+
+// ko.kontain.me/github.com/knative/build/cmd/controller -> ko build and serve
+func (s *server) resolveManifest(ctx context.Context, repo, tag string) (string, error) {
+	ip := strings.TrimPrefix(repo, "ko/") // To handle legacy behavior.
+
+	// Traverse up from the importpath to find the module root, by checking
+	// whether the path is a module path that returns a version.
+	done := serve.TimePhase(service, "walkUp")
+	module, version, err := walkUp(ctx, ip, tag)
+	done(err)
+	if err != nil {
+		return "", fmt.Errorf("walkUp: %w", err)
+	}
+
+	// Check if we've already got a manifest for this importpath + resolved version.
+	ck := cacheKey(ip, version)
+	if err := serve.VerifyManifest(ctx, s.storage, ck); err == nil {
+		serve.RecordCacheLookup(service, true)
+		slog.InfoContext(ctx, "serving cached manifest", "ck", ck)
+		return ck, nil
+	}
+	serve.RecordCacheLookup(service, false)
+
+	// Pull the module source from the module proxy and build it, unless
+	// another request is already doing so.
+	if err := s.runBuild(ctx, ck, repo, tag, module, version); err != nil {
+		return "", err
+	}
+	return ck, nil
+}
+
+// build builds the image for the cache key from the repo and tag requested,
+// and the module and version they resolved to, and writes it.
+func (s *server) build(ctx context.Context, ck string, args []string) error {
+	if len(args) != 4 {
+		return fmt.Errorf("got %d build args, want 4", len(args))
+	}
+	repo, tag, module, version := args[0], args[1], args[2], args[3]
+	ip := strings.TrimPrefix(repo, "ko/") // To handle legacy behavior.
+	filepath := strings.TrimPrefix(ip, module)
+
+	started := time.Now()
+	done := serve.TimePhase(service, "fetchAndBuild")
+	br, deps, err := s.fetchAndBuild(ctx, module, version, filepath)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("fetchAndBuild: %w", err)
+	}
+	prov := serve.Provenance{
+		BuilderID: builderID,
+		BuildType: buildType,
+		ExternalParameters: map[string]string{
+			"importPath": ip,
+			"version":    tag,
+		},
+		InternalParameters: map[string]any{
+			"module":          module,
+			"resolvedVersion": version,
+			"platforms":       "all",
+			"flags":           []string{"-mod=mod"},
+		},
+		ResolvedDependencies: deps,
+		InvocationID:         ck,
+		Started:              started,
+		Finished:             time.Now(),
+	}
+	serve.ReportProgress(ctx, "writing image")
+
+	done = serve.TimePhase(service, "write")
+	err = s.write(ctx, repo, br, ck, prov)
+	done(err)
+	if err != nil {
+		return err
+	}
+	if err := serve.RecordBuild(ctx, s.storage, service, ck, repo, map[string]any{
+		"importPath":      ip,
+		"version":         tag,
+		"module":          module,
+		"resolvedVersion": version,
+	}, br); err != nil {
+		slog.WarnContext(ctx, "serve.RecordBuild", "ck", ck, "err", err)
+	}
+	return nil
+}
+
+// write signs and attests the built image or index, then writes it, aliased
+// to the cache key.
+func (s *server) write(ctx context.Context, repo string, br build.Result, ck string, prov serve.Provenance) error {
+	if err := serve.SignImage(ctx, s.storage, s.signer, repo, br); err != nil {
+		return fmt.Errorf("serve.SignImage: %w", err)
+	}
+	if err := serve.AttestProvenance(ctx, s.storage, s.signer, repo, br, prov); err != nil {
+		return fmt.Errorf("serve.AttestProvenance: %w", err)
+	}
+	if err := s.writeSBOMs(ctx, br); err != nil {
+		return fmt.Errorf("writeSBOMs: %w", err)
+	}
+	if idx, ok := br.(v1.ImageIndex); ok {
+		if err := serve.WriteIndex(ctx, s.storage, idx, ck); err != nil {
+			return fmt.Errorf("serve.WriteIndex: %w", err)
+		}
+		return nil
+	}
+	if img, ok := br.(v1.Image); ok {
+		if err := serve.WriteImage(ctx, s.storage, img, ck); err != nil {
+			return fmt.Errorf("serve.WriteImage: %w", err)
+		}
+		return nil
+	}
+	return errors.New("image was not image or index")
+}
+
+// writeSBOMs attaches the SBOMs ko generated to the image, or to the index
+// and each image in it.
+func (s *server) writeSBOMs(ctx context.Context, br build.Result) error {
+	se, ok := br.(oci.SignedEntity)
+	if !ok {
+		return nil
+	}
+	return walk.SignedEntity(ctx, se, func(ctx context.Context, se oci.SignedEntity) error {
+		f, err := se.Attachment("sbom")
+		if err != nil {
+			// Not every level has an SBOM, and none do if SBOMs are
+			// disabled.
+			return nil
+		}
+		d, ok := se.(partial.Describable)
+		if !ok {
+			return fmt.Errorf("unexpected %T", se)
+		}
+		// Describe the attachment by the SBOM's format, like
+		// text/spdx+json, so referrers can be filtered by it.
+		mt, err := f.FileMediaType()
+		if err != nil {
+			return err
+		}
+		return serve.Attach(ctx, s.storage, "sbom", d, mutate.ConfigMediaType(f, mt))
+	})
+}
+
+func cacheKey(importpath, version string) string {
+	ck := []byte(fmt.Sprintf("%s-%s", importpath, version))
+	return fmt.Sprintf("ko-%x", md5.Sum(ck))
+}
+
+const defaultBaseImage = "gcr.io/distroless/static:nonroot"
+
+func (s *server) getBaseImage(ctx context.Context, ip string) (name.Reference, build.Result, error) {
+	base := defaultBaseImage
+	// Assuming we're in the root of the module directory, see if we can
+	// find the .ko.yaml file.
+	f, err := os.Open(".ko.yaml")
+	if err == nil {
+		defer f.Close()
+		slog.InfoContext(ctx, "Found .ko.yaml")
+		var y struct {
+			DefaultBaseImage   string            `yaml:"defaultBaseImage"`
+			BaseImageOverrides map[string]string `yaml:"baseImageOverrides"`
+		}
+		if err := yaml.NewDecoder(f).Decode(&y); err != nil {
+			return nil, nil, err
+		}
+		if y.DefaultBaseImage != "" {
+			base = y.DefaultBaseImage
+		}
+		if bio := y.BaseImageOverrides[ip]; bio != "" {
+			base = bio
+		}
+	}
+	slog.InfoContext(ctx, "Using base image", "base", base, "ip", ip)
+
+	ref, err := name.ParseReference(base)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := remote.Head(ref, remote.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	switch d.MediaType {
+	case types.DockerManifestList, types.OCIImageIndex:
+		slog.InfoContext(ctx, "Base image is index", "base", base)
+		idx, err := remote.Index(ref)
+		return ref, idx, err
+	case types.DockerManifestSchema2, types.OCIManifestSchema1:
+		slog.InfoContext(ctx, "Base image is image", "base", base)
+		img, err := remote.Image(ref)
+		return ref, img, err
+	default:
+		return nil, nil, fmt.Errorf("unknown media type: %s", d.MediaType)
+	}
+}
+
+// listTags lists the versions of the module containing the importpath known
+// to the Go module proxy, along with latest.
+func (s *server) listTags(ctx context.Context, repo string) ([]string, error) {
+	ip := strings.TrimPrefix(repo, "ko/") // To handle legacy behavior.
+	module, _, err := walkUp(ctx, ip, "latest")
+	if err != nil {
+		return nil, fmt.Errorf("walkUp: %w", err)
+	}
+	url := fmt.Sprintf("https://proxy.golang.org/%s/@v/list", module)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%d: %s", resp.StatusCode, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{"latest"}
+	for _, v := range strings.Fields(string(b)) {
+		// Versions like v2.0.0+incompatible aren't valid tags.
+		if !strings.Contains(v, "+") {
+			tags = append(tags, v)
+		}
+	}
+	return tags, nil
+}
+
+// given an importpath e.g., github.com/google/go-containerregistry/cmd/crane,
+// return its go module (github.com/google/go-containerregistry) by
+// sequentially checking whether the Go module proxy has version info for it.
+func walkUp(ctx context.Context, importpath, version string) (string, string, error) {
+	parts := strings.Split(importpath, "/")
+	for i := len(parts) - 1; i > 0; i-- {
+		check := strings.Join(parts[:i], "/")
+		if resolved, err := getVersion(ctx, check, version); err == nil {
+			return check, resolved, nil
+		}
+	}
+	return "", "", serve.Errorf(serve.NameUnknown, "no module found for %s@%s", importpath, version)
+}
+
+func getVersion(ctx context.Context, mod, version string) (string, error) {
+	url := fmt.Sprintf("https://proxy.golang.org/%s/@v/%s.info", mod, version)
+	if version == "latest" {
+		url = fmt.Sprintf("https://proxy.golang.org/%s/@latest", mod)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%d: %s", resp.StatusCode, resp.Status)
+	}
+	defer resp.Body.Close()
+	var v module.Version
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return "", err
+	}
+	return v.Version, nil
+}
+
+// fetchAndBuild fetches and builds the module, and returns the result along
+// with the module zip and base images it used.
+func (s *server) fetchAndBuild(ctx context.Context, mod, version, filepath string) (build.Result, []serve.ResourceDescriptor, error) {
+	url := fmt.Sprintf("https://proxy.golang.org/%s/@v/%s.zip", mod, version)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%d %s", resp.StatusCode, resp.Status)
+	}
+	defer resp.Body.Close()
+
+	// Write a temp zip file.
+	serve.ReportProgress(ctx, fmt.Sprintf("fetching %s@%s", mod, version))
+	tmpzip, err := os.CreateTemp("", "ko-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tmpzip.Name()) // Clean up the zip file.
+	zh := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpzip, zh), resp.Body); err != nil {
+		return nil, nil, err
+	}
+	tmpzip.Close()
+	// Record the zip's go.sum hash too, so it can be checked against the
+	// checksum database.
+	h1, err := dirhash.HashZip(tmpzip.Name(), dirhash.Hash1)
+	if err != nil {
+		return nil, nil, err
+	}
+	deps := []serve.ResourceDescriptor{{
+		URI:         url,
+		Name:        mod + "@" + version,
+		Digest:      map[string]string{"sha256": hex.EncodeToString(zh.Sum(nil))},
+		Annotations: map[string]string{"go.sum": h1},
+	}}
+
+	// Record each base image used, once.
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	getBaseImage := func(ctx context.Context, ip string) (name.Reference, build.Result, error) {
+		ref, br, err := s.getBaseImage(ctx, ip)
+		if err != nil {
+			return nil, nil, err
+		}
+		d, err := br.Digest()
+		if err != nil {
+			return nil, nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !seen[ref.String()] {
+			seen[ref.String()] = true
+			deps = append(deps, serve.ResourceDescriptor{
+				Name:   ref.String(),
+				Digest: map[string]string{d.Algorithm: d.Hex},
+			})
+		}
+		return ref, br, nil
+	}
+
+	// Create a tempdir and cd into it
+	// (This is only safe because concurrency=1)
+	tmpdir, err := os.CreateTemp("", "ko-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	// Clean up the temp dir. If building is successful, we'll serve a
+	// cached manifest and not need to rebuild.
+	defer os.RemoveAll(tmpdir.Name())
+
+	// Unzip and validate the module zip file.
+	if err := zip.Unzip(tmpdir.Name(), module.Version{
+		Path:    mod,
+		Version: version,
+	}, tmpzip.Name()); err != nil {
+		return nil, nil, err
+	}
+
+	// ko build the package.
+	opts := []build.Option{
+		build.WithBaseImages(getBaseImage),
+		build.WithPlatforms("all"),
+		build.WithConfig(map[string]build.Config{
+			mod + filepath: build.Config{
+				// Go module proxy zips include only
+				// modules.txt in vendor/, so force mod mode to
+				// avoid go build errors.
+				Flags: build.FlagArray{"-mod=mod"},
+			},
+		}),
+		build.WithCreationTime(v1.Time{Time: time.Unix(0, 0)}),
+	}
+	if s.disableSBOM {
+		opts = append(opts, build.WithDisabledSBOM())
+	}
+	g, err := build.NewGo(ctx, tmpdir.Name(), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	ip := build.StrictScheme + mod + filepath
+	if err := g.IsSupportedReference(ip); err != nil {
+		return nil, nil, err
+	}
+	slog.InfoContext(ctx, "ko build", "ip", ip)
+	serve.ReportProgress(ctx, fmt.Sprintf("building %s", ip))
+	done := serve.TimePhase(service, "build")
+	br, err := g.Build(ctx, ip)
+	done(err)
+	if err != nil {
+		return nil, nil, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return br, deps, nil
+}
@@ -0,0 +1,196 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+// New returns a registry that serves images mirrored from other registries,
+// caching them in st. Images are pulled from upstream with opts, like
+// remote.WithTransport.
+func New(st serve.Storage, opts ...remote.Option) http.Handler {
+	s := &server{storage: st, opts: opts}
+	return cors(&serve.Router{
+		Storage:         st,
+		Service:         service,
+		ResolveManifest: s.resolveManifest,
+		ResolveDigests:  true,
+		ListTags:        s.listTags,
+		Fallback:        http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/mirror", http.StatusSeeOther),
+	})
+}
+
+// service labels metrics recorded by this service.
+const service = "mirror"
+
+type server struct {
+	storage serve.Storage
+	opts    []remote.Option
+}
+
+// remoteOptions returns the options for requests to upstream registries made
+// while serving ctx.
+func (s *server) remoteOptions(ctx context.Context) []remote.Option {
+	return append(slices.Clip(s.opts), remote.WithContext(ctx))
+}
+
+func cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")                 // Allow CORS requests from any domain.
+		w.Header().Set("Access-Control-Expose-Headers", "*")               // Respond with all headers to requests from any domain.
+		w.Header().Set("Access-Control-Allow-Credentials", "true")         // Allow... credentials? I guess?
+		w.Header().Set("Access-Control-Allow-Methods", "GET,HEAD,OPTIONS") // Allow CORS requests to use these methods.
+		w.Header().Set("Access-Control-Allow-Headers", "*")                // Allow all CORS headers in the OPTIONS request.
+		if r.Method == http.MethodOptions {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// listTags lists the tags in the upstream repository.
+func (s *server) listTags(ctx context.Context, repo string) ([]string, error) {
+	for strings.HasPrefix(repo, "mirror.kontain.me/") {
+		repo = strings.TrimPrefix(repo, "mirror.kontain.me/")
+	}
+	r, err := name.NewRepository(repo)
+	if err != nil {
+		return nil, serve.Errorf(serve.NameInvalid, "name.NewRepository: %w", err)
+	}
+	return remote.List(r, s.remoteOptions(ctx)...)
+}
+
+// mirror.kontain.me/ubuntu -> mirror ubuntu and serve
+func (s *server) resolveManifest(ctx context.Context, repo, tagOrDigest string) (string, error) {
+	refstr := repo
+	if strings.HasPrefix(tagOrDigest, "sha256:") {
+		refstr += "@" + tagOrDigest
+	} else {
+		refstr += ":" + tagOrDigest
+	}
+	for strings.HasPrefix(refstr, "mirror.kontain.me/") {
+		refstr = strings.TrimPrefix(refstr, "mirror.kontain.me/")
+	}
+
+	ref, err := name.ParseReference(refstr)
+	if err != nil {
+		return "", serve.Errorf(serve.NameInvalid, "name.ParseReference: %w", err)
+	}
+
+	var idx v1.ImageIndex
+	var img v1.Image
+
+	// Get the original image's digest, and check if we have that manifest
+	// blob.
+	d, err := remote.Head(ref, s.remoteOptions(ctx)...)
+	if err != nil {
+		slog.ErrorContext(ctx, "remote.Head", "ref", ref, "err", err)
+		var desci interface {
+			Digest() (v1.Hash, error)
+			Size() (int64, error)
+			MediaType() (types.MediaType, error)
+		}
+		// HEAD failed, let's figure out if it was an index or image by doing GETs.
+		idx, err = remote.Index(ref, s.remoteOptions(ctx)...)
+		if err != nil {
+			slog.ErrorContext(ctx, "remote.Index", "ref", ref, "err", err)
+			img, err = remote.Image(ref, s.remoteOptions(ctx)...)
+			if err != nil {
+				return "", err
+			}
+			desci = img
+		} else {
+			desci = idx
+		}
+
+		h, err := desci.Digest()
+		if err != nil {
+			return "", fmt.Errorf("Digest(): %w", err)
+		}
+		sz, err := desci.Size()
+		if err != nil {
+			return "", fmt.Errorf("Size(): %w", err)
+		}
+		mt, err := desci.MediaType()
+		if err != nil {
+			return "", fmt.Errorf("MediaType(): %w", err)
+		}
+		d = &v1.Descriptor{
+			Digest:    h,
+			MediaType: mt,
+			Size:      sz,
+		}
+	}
+	if _, err := s.storage.BlobExists(ctx, d.Digest.String()); err == nil {
+		serve.RecordCacheLookup(service, true)
+		return d.Digest.String(), nil
+	} else {
+		slog.InfoContext(ctx, "BlobExists", "digest", d.Digest.String(), "err", err)
+	}
+	serve.RecordCacheLookup(service, false)
+
+	// Blob doesn't exist yet. Try to get the image manifest+layers
+	// and cache them, unless another request is already doing so.
+	if err := serve.Build(ctx, s.storage, d.Digest.String(), func(ctx context.Context) (err error) {
+		done := serve.TimePhase(service, "mirror")
+		defer func() { done(err) }()
+		switch d.MediaType {
+		case types.OCIImageIndex, types.DockerManifestList:
+			if idx == nil {
+				// If the image is a manifest list, fetch and mirror
+				// the image index.
+				idx, err = remote.Index(ref, s.remoteOptions(ctx)...)
+				if err != nil {
+					return err
+				}
+			}
+			if err := serve.WriteIndex(ctx, s.storage, idx); err != nil {
+				return fmt.Errorf("serve.WriteIndex: %w", err)
+			}
+			s.recordBuild(ctx, repo, ref, idx)
+		case types.OCIManifestSchema1, types.DockerManifestSchema2:
+			if img == nil {
+				// If it's a simple image, fetch and mirror its
+				// manifest.
+				img, err = remote.Image(ref, s.remoteOptions(ctx)...)
+				if err != nil {
+					return err
+				}
+			}
+			if err := serve.WriteImage(ctx, s.storage, img); err != nil {
+				return fmt.Errorf("serve.WriteImage: %w", err)
+			}
+			s.recordBuild(ctx, repo, ref, img)
+		default:
+			return serve.Errorf(serve.ManifestInvalid, "unknown media type: %s", d.MediaType)
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return d.Digest.String(), nil
+}
+
+// recordBuild records the mirrored image in the catalog under its digest,
+// along with the reference it was mirrored from. Failing to record it
+// doesn't fail the mirror.
+func (s *server) recordBuild(ctx context.Context, repo string, ref name.Reference, d partial.Describable) {
+	desc, err := partial.Descriptor(d)
+	if err == nil {
+		err = serve.RecordBuild(ctx, s.storage, service, desc.Digest.String(), repo, map[string]any{"ref": ref.String()}, d)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "serve.RecordBuild", "ref", ref, "err", err)
+	}
+}
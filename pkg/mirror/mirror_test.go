@@ -0,0 +1,119 @@
+package mirror
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"github.com/imjasonh/kontain.me/pkg/serve/servetest"
+)
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+	tr := servetest.Upstream(t)
+	upstream := remote.WithTransport(tr)
+	host := servetest.Serve(t, New(serve.NewMemoryStorage(), upstream))
+
+	img, err := random.Image(1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(name.MustParseReference(servetest.UpstreamHost+"/test/image:latest"), img, upstream); err != nil {
+		t.Fatalf("remote.Write: %v", err)
+	}
+	idx, err := random.Index(1000, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(name.MustParseReference(servetest.UpstreamHost+"/test/index:latest"), idx, upstream); err != nil {
+		t.Fatalf("remote.WriteIndex: %v", err)
+	}
+
+	// Images are mirrored by tag and by digest, with the same digest as
+	// upstream.
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := name.NewRepository(host + "/" + servetest.UpstreamHost + "/test/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []name.Reference{repo.Tag("latest"), repo.Digest(d.String())} {
+		desc, err := remote.Head(ref)
+		if err != nil {
+			t.Fatalf("remote.Head(%s): %v", ref, err)
+		}
+		if desc.Digest != d {
+			t.Errorf("HEAD %s got digest %s, want %s", ref, desc.Digest, d)
+		}
+		got, err := remote.Image(ref)
+		if err != nil {
+			t.Fatalf("remote.Image(%s): %v", ref, err)
+		}
+		if err := validate.Image(got); err != nil {
+			t.Errorf("validate.Image(%s): %v", ref, err)
+		}
+		if gd, err := got.Digest(); err != nil {
+			t.Fatal(err)
+		} else if gd != d {
+			t.Errorf("%s got digest %s, want %s", ref, gd, d)
+		}
+	}
+
+	// Once mirrored, images are served from storage, even if their blobs
+	// are gone upstream.
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ld, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	servetest.DeleteUpstreamBlob(t, tr, "test/image", ld)
+	cached, err := remote.Image(repo.Tag("latest"))
+	if err != nil {
+		t.Fatalf("remote.Image: %v", err)
+	}
+	if err := validate.Image(cached); err != nil {
+		t.Errorf("validate.Image: %v", err)
+	}
+
+	// Indexes are mirrored with all of their images.
+	ref := repo.Registry.Repo(servetest.UpstreamHost, "test", "index").Tag("latest")
+	gotIdx, err := remote.Index(ref)
+	if err != nil {
+		t.Fatalf("remote.Index(%s): %v", ref, err)
+	}
+	if err := validate.Index(gotIdx); err != nil {
+		t.Errorf("validate.Index(%s): %v", ref, err)
+	}
+	wantD, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotD, err := gotIdx.Digest(); err != nil {
+		t.Fatal(err)
+	} else if gotD != wantD {
+		t.Errorf("%s got digest %s, want %s", ref, gotD, wantD)
+	}
+
+	// Errors from upstream are passed on to clients.
+	missing := repo.Tag("missing")
+	if _, err := remote.Image(missing); servetest.ErrorCode(err) != "MANIFEST_UNKNOWN" {
+		t.Errorf("remote.Image(%s): got %v, want MANIFEST_UNKNOWN", missing, err)
+	}
+
+	tags, err := remote.List(repo)
+	if err != nil {
+		t.Fatalf("remote.List: %v", err)
+	}
+	if want := []string{"latest"}; !slices.Equal(tags, want) {
+		t.Errorf("remote.List: got %v, want %v", tags, want)
+	}
+}
@@ -0,0 +1,75 @@
+package random
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+// New returns a registry that serves randomly-generated images, writing them
+// to st.
+func New(st serve.Storage) http.Handler {
+	s := &server{storage: st}
+	return &serve.Router{
+		Storage:         st,
+		Service:         service,
+		ResolveManifest: s.resolveManifest,
+		ListTags:        s.listTags,
+		Fallback:        http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/random", http.StatusSeeOther),
+	}
+}
+
+// service names this service's Router.
+const service = "random"
+
+type server struct{ storage serve.Storage }
+
+// Capture up to 99 layers of up to 99.9MB each.
+var randomTagRE = regexp.MustCompile("([0-9]{1,2})x([0-9]{1,8})")
+
+// exampleTags are listed as the repository's tags, since any tag matching
+// randomTagRE is served.
+var exampleTags = []string{"latest", "1x10000000", "3x1000000", "10x100000"}
+
+func (s *server) listTags(context.Context, string) ([]string, error) { return exampleTags, nil }
+
+// random.kontain.me:3x10mb
+// random.kontain.me(:latest) -> 1x10mb
+func (s *server) resolveManifest(ctx context.Context, repo, tag string) (string, error) {
+	var num, size int64 = 1, 10000000 // 10MB
+
+	// Captured requested num + size from tag.
+	all := randomTagRE.FindStringSubmatch(tag)
+	if len(all) >= 3 {
+		num, _ = strconv.ParseInt(all[1], 10, 64)
+		size, _ = strconv.ParseInt(all[2], 10, 64)
+	}
+	// Every pull generates a new image, of up to 99 layers of about 100MB,
+	// so it's charged as a build.
+	if err := serve.ChargeBuild(ctx); err != nil {
+		return "", err
+	}
+	slog.InfoContext(ctx, "generating random image", "layers", num, "size", size)
+
+	// Generate a random image.
+	img, err := random.Image(size, num)
+	if err != nil {
+		return "", fmt.Errorf("random.Image: %w", err)
+	}
+	if err := serve.WriteImage(ctx, s.storage, img); err != nil {
+		return "", fmt.Errorf("serve.WriteImage: %w", err)
+	}
+	// Random images aren't cached by key, or recorded in the catalog, since
+	// every pull generates a new one; they're served by digest.
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
@@ -0,0 +1,78 @@
+package random
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"github.com/imjasonh/kontain.me/pkg/serve/servetest"
+)
+
+func TestRandom(t *testing.T) {
+	t.Parallel()
+	host := servetest.Serve(t, New(serve.NewMemoryStorage()))
+	repo, err := name.NewRepository(host + "/random")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// By tag, each image is generated anew with the requested layers.
+	img, err := remote.Image(repo.Tag("3x1000"))
+	if err != nil {
+		t.Fatalf("remote.Image: %v", err)
+	}
+	if err := validate.Image(img); err != nil {
+		t.Errorf("validate.Image: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 3 {
+		t.Errorf("got %d layers, want 3", len(layers))
+	}
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// By digest, the image that was generated is served from storage.
+	desc, err := remote.Head(repo.Digest(d.String()))
+	if err != nil {
+		t.Fatalf("remote.Head: %v", err)
+	}
+	if desc.Digest != d {
+		t.Errorf("HEAD got digest %s, want %s", desc.Digest, d)
+	}
+	byDigest, err := remote.Image(repo.Digest(d.String()))
+	if err != nil {
+		t.Fatalf("remote.Image: %v", err)
+	}
+	if err := validate.Image(byDigest); err != nil {
+		t.Errorf("validate.Image: %v", err)
+	}
+	if got, err := byDigest.Digest(); err != nil {
+		t.Fatal(err)
+	} else if got != d {
+		t.Errorf("got digest %s, want %s", got, d)
+	}
+
+	// Digests that were never generated aren't found.
+	unknown := repo.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	if _, err := remote.Image(unknown); servetest.ErrorCode(err) != "MANIFEST_UNKNOWN" {
+		t.Errorf("remote.Image(%s): got %v, want MANIFEST_UNKNOWN", unknown, err)
+	}
+
+	tags, err := remote.List(repo)
+	if err != nil {
+		t.Fatalf("remote.List: %v", err)
+	}
+	want := slices.Clone(exampleTags)
+	slices.Sort(want)
+	if !slices.Equal(tags, want) {
+		t.Errorf("remote.List: got %v, want %v", tags, want)
+	}
+}
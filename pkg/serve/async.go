@@ -0,0 +1,312 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/imjasonh/delay/pkg/delay"
+)
+
+const (
+	// asyncRetryAfter is how long clients are told to wait before retrying
+	// a request for an image that's being built asynchronously.
+	asyncRetryAfter = 10 * time.Second
+
+	// asyncStaleAfter is how long an asynchronous build can go without
+	// reporting progress before it's assumed to have been lost, and a new
+	// one is enqueued. It's longer than any build is allowed to run.
+	asyncStaleAfter = 30 * time.Minute
+
+	// buildQueue is the Cloud Tasks queue asynchronous builds are
+	// enqueued to.
+	buildQueue = "build-queue"
+)
+
+// BuildState is the state of an asynchronous build.
+type BuildState string
+
+const (
+	BuildRunning BuildState = "running"
+	BuildDone    BuildState = "done"
+	BuildFailed  BuildState = "failed"
+)
+
+// BuildStatus describes the progress of an asynchronous build of a cache key.
+type BuildStatus struct {
+	Key string `json:"key"`
+	// Service and Repo are the repository the build was started for,
+	// which users must be able to pull to see its status.
+	Service  string     `json:"service,omitempty"`
+	Repo     string     `json:"repo,omitempty"`
+	State    BuildState `json:"state"`
+	Progress string     `json:"progress,omitempty"`
+	Started  time.Time  `json:"started"`
+	Updated  time.Time  `json:"updated"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	// Code is the registry error code the build failed with, if any.
+	Code ErrorCode `json:"code,omitempty"`
+}
+
+// Each build's status is stored in an object named "status-<cache key>", so
+// that it's shared by every instance, and survives the instance that's
+// building it.
+func statusName(ck string) string { return "status-" + ck }
+
+// readStatus returns the stored status of the build of the cache key, and the
+// generation of the object it's stored in.
+func readStatus(ctx context.Context, st Storage, ck string) (BuildStatus, int64, error) {
+	contents, gen, err := st.readObject(ctx, statusName(ck))
+	if err != nil {
+		return BuildStatus{}, 0, err
+	}
+	var bs BuildStatus
+	if err := json.Unmarshal([]byte(contents), &bs); err != nil {
+		return BuildStatus{}, 0, fmt.Errorf("parsing status of %q: %w", ck, err)
+	}
+	return bs, gen, nil
+}
+
+// writeStatus replaces the stored status of the build of the cache key if
+// it's still at generation gen, or creates it if gen is 0, and returns its new
+// generation.
+func writeStatus(ctx context.Context, st Storage, bs BuildStatus, gen int64) (int64, error) {
+	bs.Updated = time.Now()
+	b, err := json.Marshal(bs)
+	if err != nil {
+		return 0, err
+	}
+	return st.putObject(ctx, statusName(bs.Key), string(b), gen)
+}
+
+// updateStatus applies fn to the stored status of the build of the cache key,
+// or to a new status if there isn't one, retrying if another writer changes it
+// concurrently.
+func updateStatus(ctx context.Context, st Storage, ck string, fn func(*BuildStatus)) error {
+	for {
+		bs, gen, err := readStatus(ctx, st, ck)
+		if isNotExist(err) {
+			bs, gen = BuildStatus{Key: ck, State: BuildRunning, Started: time.Now()}, 0
+		} else if err != nil {
+			return err
+		}
+		fn(&bs)
+		if _, err := writeStatus(ctx, st, bs, gen); !errors.Is(err, errConflict) {
+			return err
+		}
+	}
+}
+
+// asyncBuild is stored in the context of an asynchronous build.
+type asyncBuild struct {
+	st Storage
+	ck string
+}
+
+type buildKey struct{}
+
+// ReportProgress records a description of what an asynchronous build is
+// currently doing, which is reported by the status endpoint. It does nothing
+// if ctx isn't the context of an asynchronous build.
+func ReportProgress(ctx context.Context, progress string) {
+	ab, ok := ctx.Value(buildKey{}).(asyncBuild)
+	if !ok {
+		return
+	}
+	slog.InfoContext(ctx, "build progress", "ck", ab.ck, "progress", progress)
+	if err := updateStatus(ctx, ab.st, ab.ck, func(bs *BuildStatus) { bs.Progress = progress }); err != nil {
+		slog.WarnContext(ctx, "updating build status", "ck", ab.ck, "err", err)
+	}
+}
+
+// AsyncBuildFunc builds the image for the cache key ck from the args passed
+// to BuildAsync, and writes it to storage.
+type AsyncBuildFunc func(ctx context.Context, ck string, args []string) error
+
+type asyncBuilder struct {
+	st Storage
+	fn AsyncBuildFunc
+}
+
+var asyncBuilders sync.Map // service name -> asyncBuilder
+
+// RegisterAsyncBuild registers fn to run the builds BuildAsync enqueues for
+// the service. Services that build asynchronously must register their builds
+// when they're created, since builds may run on any instance.
+func RegisterAsyncBuild(service string, st Storage, fn AsyncBuildFunc) {
+	asyncBuilders.Store(service, asyncBuilder{st: st, fn: fn})
+}
+
+// InitTasks registers the handler that runs tasks enqueued by BuildAsync and
+// the wait service, when running on GCP. Commands that serve those should
+// call it once at startup.
+func InitTasks() {
+	if metadata.OnGCE() {
+		delay.Init()
+	}
+}
+
+// buildTask runs builds enqueued by BuildAsync.
+var buildTask = delay.Func("build", runBuildTask)
+
+// runBuildTask runs a build enqueued by BuildAsync, and records its result in
+// the build's status. Builds that fail are recorded and not retried, but if
+// the task is lost, e.g., because the instance running it dies, Cloud Tasks
+// retries it.
+func runBuildTask(ctx context.Context, service, repo, host, prefix, ck string, args []string) error {
+	v, ok := asyncBuilders.Load(service)
+	if !ok {
+		return fmt.Errorf("no asynchronous builds registered for %q", service)
+	}
+	b := v.(asyncBuilder)
+
+	// Builds expect to see the request that started them, e.g., to name
+	// the repository images are signed for, including any prefix that was
+	// stripped from its path before it was routed.
+	ctx = context.WithValue(ctx, requestKey{}, &http.Request{
+		Host:       host,
+		RequestURI: "/v2/" + prefix,
+		URL:        &url.URL{Path: "/v2/"},
+	})
+	ctx = context.WithValue(ctx, repoKey{}, repoRef{Service: service, Repo: repo})
+	ctx = context.WithValue(ctx, buildKey{}, asyncBuild{st: b.st, ck: ck})
+	err := Build(ctx, b.st, ck, func(ctx context.Context) error {
+		return b.fn(ctx, ck, args)
+	})
+	if uerr := updateStatus(ctx, b.st, ck, func(bs *BuildStatus) {
+		now := time.Now()
+		bs.Service, bs.Repo = service, repo
+		bs.Finished = &now
+		bs.Progress = ""
+		if err != nil {
+			bs.State = BuildFailed
+			bs.Error = err.Error()
+			var rerr *RegistryError
+			if errors.As(err, &rerr) {
+				bs.Code = rerr.Code
+			}
+		} else {
+			bs.State = BuildDone
+		}
+	}); uerr != nil {
+		// Without a status, the next request would wait for the build
+		// until it's stale; retry the task instead.
+		return fmt.Errorf("updating build status: %w", uerr)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "async build failed", "ck", ck, "err", err)
+	}
+	return nil
+}
+
+// BuildAsync is like Build, but instead of waiting for the build to finish it
+// enqueues a Cloud Tasks task to build the image, and returns a retryable
+// error telling the client to try again later. The task calls the build
+// registered for the service by RegisterAsyncBuild with args, on whichever
+// instance Cloud Tasks sends it to. Once the build finishes the cached
+// manifest is served by the next request.
+//
+// The build's status is stored alongside the image, so every instance can
+// report it. If the last asynchronous build of the cache key failed, its
+// error is returned once, and the next request enqueues a new build.
+func BuildAsync(ctx context.Context, st Storage, service, ck string, args ...string) error {
+	bs, gen, err := readStatus(ctx, st, ck)
+	switch {
+	case err != nil && !isNotExist(err):
+		return fmt.Errorf("reading build status: %w", err)
+	case err == nil && bs.State == BuildRunning && time.Since(bs.Updated) < asyncStaleAfter:
+		return Retryable(Unavailable, asyncRetryAfter, "building image; retry later, or see /status/%s for progress", ck)
+	case err == nil && bs.State == BuildFailed:
+		// Only the request that forgets the failure reports it.
+		if err := st.deleteIf(ctx, statusName(ck), gen); err == nil {
+			code := bs.Code
+			if code == "" {
+				code = Unknown
+			}
+			return Errorf(code, "%s", bs.Error)
+		}
+		return Retryable(Unavailable, asyncRetryAfter, "building image; retry later, or see /status/%s for progress", ck)
+	}
+
+	now := time.Now()
+	repo := repoFromContext(ctx).Repo
+	gen, err = writeStatus(ctx, st, BuildStatus{Key: ck, Service: service, Repo: repo, State: BuildRunning, Progress: "queued", Started: now}, gen)
+	if errors.Is(err, errConflict) {
+		// Another request enqueued the build first.
+		return Retryable(Unavailable, asyncRetryAfter, "building image; retry later, or see /status/%s for progress", ck)
+	} else if err != nil {
+		return fmt.Errorf("writing build status: %w", err)
+	}
+	// Only the request that starts the build is charged for it, not those
+	// polling one in progress.
+	if err := ChargeBuild(ctx); err != nil {
+		if err := st.deleteIf(ctx, statusName(ck), gen); err != nil {
+			slog.WarnContext(ctx, "deleting build status", "ck", ck, "err", err)
+		}
+		return err
+	}
+	r := RequestFromContext(ctx)
+	if r == nil {
+		return errors.New("BuildAsync called outside of a request")
+	}
+	if err := buildTask.Call(ctx, r, buildQueue, delay.WithArgs(service, repo, r.Host, clientPrefix(r), ck, args)); err != nil {
+		if err := st.delete(ctx, statusName(ck)); err != nil {
+			slog.WarnContext(ctx, "deleting build status", "ck", ck, "err", err)
+		}
+		return fmt.Errorf("enqueueing build: %w", err)
+	}
+	return Retryable(Unavailable, asyncRetryAfter, "building image; retry later, or see /status/%s for progress", ck)
+}
+
+// serveStatus serves the status of the build of the cache key named in the
+// request path as JSON, if the user can pull the repository the build was
+// started for. Builds that weren't asynchronous belong to the repository
+// recorded with their logs.
+func (rt *Router) serveStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ck := strings.TrimPrefix(r.URL.Path, "/status/")
+	if ck == "" || strings.Contains(ck, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	bs, _, err := readStatus(ctx, rt.Storage, ck)
+	if err != nil {
+		// There's no asynchronous build of the image; check whether
+		// it's being built synchronously, or has been built.
+		switch {
+		case !isNotExist(err):
+			slog.ErrorContext(ctx, "reading build status", "ck", ck, "err", err)
+			http.Error(w, "reading build status", http.StatusInternalServerError)
+			return
+		case VerifyManifest(ctx, rt.Storage, ck) == nil:
+			bs = BuildStatus{Key: ck, State: BuildDone}
+		case leaseHeld(ctx, rt.Storage, ck):
+			bs = BuildStatus{Key: ck, State: BuildRunning, Progress: "building on another instance"}
+		default:
+			http.Error(w, fmt.Sprintf("no build found for %q", ck), http.StatusNotFound)
+			return
+		}
+		if rec, err := readLogs(ctx, rt.Storage, ck); err == nil {
+			bs.Service, bs.Repo = rec.Service, rec.Repo
+		}
+	}
+	if _, ok := rt.authorizeRepo(w, r, repoRef{Service: bs.Service, Repo: bs.Repo}); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(bs); err != nil && !errors.Is(err, context.Canceled) {
+		slog.ErrorContext(ctx, "encoding status", "ck", ck, "err", err)
+	}
+}
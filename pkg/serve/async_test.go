@@ -0,0 +1,106 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestAsyncBuild(t *testing.T) {
+	for _, c := range []struct {
+		desc      string
+		build     func(ctx context.Context, st Storage, ck string) error
+		wantState BuildState
+		wantCode  ErrorCode
+	}{{
+		desc: "success",
+		build: func(ctx context.Context, st Storage, ck string) error {
+			ReportProgress(ctx, "writing image")
+			bs, _, err := readStatus(ctx, st, ck)
+			if err != nil || bs.Progress != "writing image" {
+				t.Errorf("during build: got status %+v, %v; want progress reported", bs, err)
+			}
+			img, err := random.Image(100, 1)
+			if err != nil {
+				return err
+			}
+			return WriteImage(ctx, st, img, ck)
+		},
+		wantState: BuildDone,
+	}, {
+		desc: "registry error",
+		build: func(context.Context, Storage, string) error {
+			return Errorf(NameUnknown, "no such module")
+		},
+		wantState: BuildFailed,
+		wantCode:  NameUnknown,
+	}, {
+		desc: "other error",
+		build: func(context.Context, Storage, string) error {
+			return errors.New("out of disk")
+		},
+		wantState: BuildFailed,
+		wantCode:  Unknown,
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			st := NewMemoryStorage()
+			service := "test-" + c.desc
+			ck := "async-" + c.desc
+			RegisterAsyncBuild(service, st, func(ctx context.Context, ck string, args []string) error {
+				if len(args) != 1 || args[0] != "arg" {
+					t.Errorf("got args %q, want [arg]", args)
+				}
+				return c.build(ctx, st, ck)
+			})
+
+			// Enqueueing the build marks it as running, which
+			// clients are told to wait for.
+			if _, err := writeStatus(ctx, st, BuildStatus{Key: ck, State: BuildRunning, Started: time.Now()}, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := BuildAsync(ctx, st, service, ck, "arg"); !isUnavailable(err) {
+				t.Errorf("BuildAsync while running: got %v, want UNAVAILABLE", err)
+			}
+
+			if err := runBuildTask(ctx, service, "repo", "example.com", "", ck, []string{"arg"}); err != nil {
+				t.Fatalf("runBuildTask: %v", err)
+			}
+			bs, _, err := readStatus(ctx, st, ck)
+			if err != nil {
+				t.Fatalf("readStatus: %v", err)
+			}
+			if bs.State != c.wantState || bs.Finished == nil {
+				t.Errorf("got status %+v, want finished and %s", bs, c.wantState)
+			}
+			// The status and logs belong to the repository the
+			// build was started for.
+			if bs.Service != service || bs.Repo != "repo" {
+				t.Errorf("got status for %s/%s, want %s/repo", bs.Service, bs.Repo, service)
+			}
+			if rec, err := readLogs(ctx, st, ck); err != nil || rec.Service != service || rec.Repo != "repo" {
+				t.Errorf("readLogs: got %+v, %v; want logs for %s/repo", rec.repoRef, err, service)
+			}
+			if c.wantState != BuildFailed {
+				return
+			}
+
+			// The failure is reported once, and then forgotten.
+			var rerr *RegistryError
+			if err := BuildAsync(ctx, st, service, ck, "arg"); !errors.As(err, &rerr) || rerr.Code != c.wantCode {
+				t.Errorf("BuildAsync after failure: got %v, want %s", err, c.wantCode)
+			}
+			if _, _, err := readStatus(ctx, st, ck); !isNotExist(err) {
+				t.Errorf("status after reporting failure: got %v, want not exist", err)
+			}
+		})
+	}
+}
+
+func isUnavailable(err error) bool {
+	var rerr *RegistryError
+	return errors.As(err, &rerr) && rerr.Code == Unavailable
+}
@@ -0,0 +1,476 @@
+package serve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tokenTTL is how long tokens issued by the token endpoint are valid.
+const tokenTTL = 5 * time.Minute
+
+// Auth requires clients to authenticate with the bearer token flow used by
+// Docker registries: unauthenticated requests are challenged to fetch a token
+// from /token with their credentials, and the token grants access to the
+// repositories allowed by the access rules.
+type Auth struct {
+	// users maps usernames to bcrypt hashes of their passwords.
+	users map[string][]byte
+	// rules grant users access to repositories. If there are none, every
+	// user can pull from and push to every repository.
+	rules []accessRule
+	// key signs tokens.
+	key []byte
+	// unknownUser is checked against the password given for unknown users,
+	// so they take as long to reject as wrong passwords.
+	unknownUser []byte
+}
+
+// accessRule allows a user, or every user if it's "*", the actions on
+// repositories whose names match the pattern.
+type accessRule struct {
+	user    string
+	pattern *regexp.Regexp
+	actions []string
+}
+
+// NewAuth returns an Auth configured by the environment, or nil if no
+// credentials are configured:
+//
+//   - $AUTH_HTPASSWD names an htpasswd file of users and bcrypt password
+//     hashes, like those written by htpasswd -B.
+//   - $AUTH_USERS lists static credentials, as user:password pairs separated
+//     by commas.
+//   - $AUTH_ACCESS lists access rules, as user:pattern:actions triples
+//     separated by spaces, like "alice:github.com/myorg/*:pull,push
+//     *:*:pull". A user of * matches every user, and * in a pattern matches
+//     anything, including slashes. If there are no rules, every user can pull
+//     and push everything.
+//   - $AUTH_TOKEN_KEY is the secret that signs tokens, which is required if
+//     any credentials are configured. Every instance must share the key, so
+//     that tokens issued by one are accepted by the others.
+func NewAuth() (*Auth, error) {
+	a := &Auth{users: map[string][]byte{}}
+	if path := os.Getenv("AUTH_HTPASSWD"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading $AUTH_HTPASSWD: %w", err)
+		}
+		if err := a.parseHtpasswd(b); err != nil {
+			return nil, fmt.Errorf("parsing $AUTH_HTPASSWD: %w", err)
+		}
+	}
+	if users := os.Getenv("AUTH_USERS"); users != "" {
+		for _, u := range strings.Split(users, ",") {
+			user, pass, ok := strings.Cut(strings.TrimSpace(u), ":")
+			if !ok || user == "" {
+				return nil, fmt.Errorf("parsing $AUTH_USERS: want user:password, got %q", u)
+			}
+			h, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+			if err != nil {
+				return nil, fmt.Errorf("hashing password for %q: %w", user, err)
+			}
+			a.users[user] = h
+		}
+	}
+	if len(a.users) == 0 {
+		return nil, nil
+	}
+	// A random key would only be accepted by the instance that chose it.
+	if a.key = []byte(os.Getenv("AUTH_TOKEN_KEY")); len(a.key) == 0 {
+		return nil, errors.New("$AUTH_TOKEN_KEY must be set when credentials are configured")
+	}
+	for _, r := range strings.Fields(os.Getenv("AUTH_ACCESS")) {
+		rule, err := parseAccessRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("parsing $AUTH_ACCESS: %w", err)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	var err error
+	if a.unknownUser, err = bcrypt.GenerateFromPassword([]byte("unknown"), bcrypt.DefaultCost); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parseHtpasswd adds the users in an htpasswd file. Only bcrypt hashes are
+// supported.
+func (a *Auth) parseHtpasswd(b []byte) error {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("invalid line %q", line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("user %q: only bcrypt hashes are supported: %w", user, err)
+		}
+		a.users[user] = []byte(hash)
+	}
+	return s.Err()
+}
+
+// parseAccessRule parses a rule of the form user:pattern:actions. The
+// pattern can contain colons, like localhost:5000/*.
+func parseAccessRule(s string) (accessRule, error) {
+	user, rest, ok := strings.Cut(s, ":")
+	i := strings.LastIndex(rest, ":")
+	if !ok || user == "" || i <= 0 {
+		return accessRule{}, fmt.Errorf("want user:pattern:actions, got %q", s)
+	}
+	pattern, actions := rest[:i], rest[i+1:]
+	re, err := regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+	if err != nil {
+		return accessRule{}, err
+	}
+	rule := accessRule{user: user, pattern: re}
+	for _, act := range strings.Split(actions, ",") {
+		if act != "pull" && act != "push" && act != "*" {
+			return accessRule{}, fmt.Errorf("unknown action %q in %q", act, s)
+		}
+		rule.actions = append(rule.actions, act)
+	}
+	return rule, nil
+}
+
+// defaultAuth is the Auth used by Routers that don't set one.
+var defaultAuth = sync.OnceValues(NewAuth)
+
+// auth returns the Auth the Router enforces, or nil if it's anonymous.
+func (rt *Router) auth() (*Auth, error) {
+	if rt.Auth != nil {
+		return rt.Auth, nil
+	}
+	return defaultAuth()
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the name of the user who authenticated the
+// request being served by a Router, or "" if it's anonymous.
+func IdentityFromContext(ctx context.Context) string {
+	s, _ := ctx.Value(identityKey{}).(string)
+	return s
+}
+
+// checkPassword reports whether the password is the user's.
+func (a *Auth) checkPassword(user, pass string) bool {
+	h, ok := a.users[user]
+	if !ok {
+		h = a.unknownUser
+	}
+	return bcrypt.CompareHashAndPassword(h, []byte(pass)) == nil && ok
+}
+
+// allowed returns the actions the user may take on the repository.
+func (a *Auth) allowed(user, repo string) []string {
+	if len(a.rules) == 0 {
+		return []string{"pull", "push"}
+	}
+	var out []string
+	for _, r := range a.rules {
+		if (r.user != "*" && r.user != user) || !r.pattern.MatchString(repo) {
+			continue
+		}
+		for _, act := range r.actions {
+			if act == "*" {
+				return []string{"pull", "push"}
+			}
+			if !slices.Contains(out, act) {
+				out = append(out, act)
+			}
+		}
+	}
+	return out
+}
+
+// scope is a resource and the actions requested or granted on it, like
+// repository:foo/bar:pull,push.
+type scope struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+func (s scope) String() string {
+	return fmt.Sprintf("%s:%s:%s", s.Type, s.Name, strings.Join(s.Actions, ","))
+}
+
+// repoScope returns the scope needed to take the actions on a repository.
+func repoScope(repo string, actions ...string) scope {
+	return scope{Type: "repository", Name: repo, Actions: actions}
+}
+
+// repoName returns the name of the repository the service built, as access
+// rules on the Router match it. A service's Router names its repositories as
+// it sees them, and a Router without a Service, like kontain's, names them
+// with the service as a prefix, like ko/github.com/myorg/app, as it lists
+// them.
+func (rt *Router) repoName(ref repoRef) string {
+	if rt.Service == "" && ref.Service != "" {
+		return ref.Service + "/" + ref.Repo
+	}
+	return ref.Repo
+}
+
+// canPull reports whether the user who authenticated the request being served
+// may pull the repository, so that it can be listed to them.
+func (rt *Router) canPull(ctx context.Context, ref repoRef) bool {
+	a, err := rt.auth()
+	if err != nil {
+		return false
+	}
+	if a == nil {
+		return true
+	}
+	return slices.Contains(a.allowed(IdentityFromContext(ctx), rt.repoName(ref)), "pull")
+}
+
+// authorizeRepo authorizes the request to read something that belongs to the
+// repository, like the status or logs of a build of one of its images, as if
+// it were pulling from the repository. If the repository isn't known, only
+// users allowed to pull everything are authorized.
+func (rt *Router) authorizeRepo(w http.ResponseWriter, r *http.Request, ref repoRef) (*http.Request, bool) {
+	if ref.Repo == "" {
+		if a, _ := rt.auth(); a != nil && !slices.Contains(a.allowed(IdentityFromContext(r.Context()), ""), "pull") {
+			Error(w, Errorf(Denied, "no repository is recorded for %s", r.URL.Path))
+			return nil, false
+		}
+		return r, true
+	}
+	return rt.authorize(w, r, repoScope(rt.repoName(ref), "pull"))
+}
+
+// catalogScope is required to list repositories at /v2/_catalog.
+var catalogScope = scope{Type: "registry", Name: "catalog", Actions: []string{"*"}}
+
+// parseScope parses a scope. The name can contain colons, like
+// repository:localhost:5000/foo:pull.
+func parseScope(s string) (scope, bool) {
+	typ, rest, ok := strings.Cut(s, ":")
+	i := strings.LastIndex(rest, ":")
+	if !ok || i <= 0 {
+		return scope{}, false
+	}
+	return scope{Type: typ, Name: rest[:i], Actions: strings.Split(rest[i+1:], ",")}, true
+}
+
+// grant returns the requested scope, limited to the actions the user is
+// allowed. Every user may list the catalog, which only lists the repositories
+// they may pull.
+func (a *Auth) grant(user string, req scope) scope {
+	out := scope{Type: req.Type, Name: req.Name, Actions: []string{}}
+	switch req.Type {
+	case "registry":
+		if req.Name == catalogScope.Name {
+			out.Actions = catalogScope.Actions
+		}
+	case "repository":
+		allowed := a.allowed(user, req.Name)
+		for _, act := range req.Actions {
+			if slices.Contains(allowed, act) {
+				out.Actions = append(out.Actions, act)
+			}
+		}
+	}
+	return out
+}
+
+// tokenClaims are the claims in a token issued by the token endpoint.
+type tokenClaims struct {
+	Subject  string  `json:"sub"`
+	Access   []scope `json:"access"`
+	IssuedAt int64   `json:"iat"`
+	Expires  int64   `json:"exp"`
+}
+
+// tokenHeader is the header of every token: they're JWTs signed with
+// HMAC-SHA256.
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (a *Auth) sign(c tokenClaims) (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(b)
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verify returns the claims of a token signed by sign, if it's valid and
+// hasn't expired.
+func (a *Auth) verify(token string) (tokenClaims, error) {
+	signed, sig, ok := strings.Cut(strings.TrimPrefix(token, tokenHeader+"."), ".")
+	if !ok || !strings.HasPrefix(token, tokenHeader+".") {
+		return tokenClaims{}, errors.New("malformed token")
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return tokenClaims{}, errors.New("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(tokenHeader + "." + signed))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return tokenClaims{}, errors.New("invalid token signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(signed)
+	if err != nil {
+		return tokenClaims{}, errors.New("malformed token claims")
+	}
+	var c tokenClaims
+	if err := json.Unmarshal(b, &c); err != nil {
+		return tokenClaims{}, errors.New("malformed token claims")
+	}
+	if time.Now().Unix() >= c.Expires {
+		return tokenClaims{}, errors.New("token expired")
+	}
+	return c, nil
+}
+
+// serveToken serves the token endpoint of the Router's Auth, if any.
+func (rt *Router) serveToken(w http.ResponseWriter, r *http.Request) {
+	a, err := rt.auth()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "NewAuth", "err", err)
+		Error(w, Errorf(Unknown, "authentication is misconfigured"))
+		return
+	}
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+	a.serveToken(w, r)
+}
+
+// serveToken issues tokens to clients that authenticate with basic auth,
+// granting the scopes they request as far as the access rules allow.
+func (a *Auth) serveToken(w http.ResponseWriter, r *http.Request) {
+	user, pass, ok := r.BasicAuth()
+	if !ok || !a.checkPassword(user, pass) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="kontain.me"`)
+		Error(w, Errorf(Unauthorized, "invalid username or password"))
+		return
+	}
+	now := time.Now()
+	c := tokenClaims{
+		Subject:  user,
+		Access:   []scope{},
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(tokenTTL).Unix(),
+	}
+	for _, s := range r.URL.Query()["scope"] {
+		for _, s := range strings.Fields(s) {
+			req, ok := parseScope(s)
+			if !ok {
+				Error(w, Errorf(Unsupported, "invalid scope %q", s))
+				return
+			}
+			c.Access = append(c.Access, a.grant(user, req))
+		}
+	}
+	token, err := a.sign(c)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "issued token", "user", user, "access", c.Access)
+	w.Header().Set("Cache-Control", "no-store")
+	serveJSON(w, r, map[string]any{
+		"token":        token,
+		"access_token": token,
+		"expires_in":   int(tokenTTL.Seconds()),
+		"issued_at":    now.UTC().Format(time.RFC3339),
+	})
+}
+
+// authenticate returns the user and scopes granted to the request, which
+// carries either a token issued by serveToken or basic auth credentials.
+// Basic auth is accepted for clients like curl, and is granted everything
+// the user is allowed.
+func (a *Auth) authenticate(r *http.Request, need scope) (string, []scope, error) {
+	if user, pass, ok := r.BasicAuth(); ok {
+		if !a.checkPassword(user, pass) {
+			return "", nil, errors.New("invalid username or password")
+		}
+		return user, []scope{a.grant(user, need)}, nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", nil, errors.New("authentication required")
+	}
+	c, err := a.verify(token)
+	if err != nil {
+		return "", nil, err
+	}
+	return c.Subject, c.Access, nil
+}
+
+// covers reports whether the granted scopes include every action needed.
+func covers(granted []scope, need scope) bool {
+	for _, act := range need.Actions {
+		if !slices.ContainsFunc(granted, func(s scope) bool {
+			return s.Type == need.Type && s.Name == need.Name && slices.Contains(s.Actions, act)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// authorize checks that the request is authenticated and, if need has any
+// actions, that it's granted them. If it is, it returns the request with the
+// user's identity in its context. If it isn't authenticated, it challenges the
+// client to fetch a token with the needed scope, and if it's authenticated but
+// not granted the scope, it's denied: a new token wouldn't grant any more.
+func (rt *Router) authorize(w http.ResponseWriter, r *http.Request, need scope) (*http.Request, bool) {
+	a, err := rt.auth()
+	if err != nil {
+		// Fail closed if auth is misconfigured.
+		slog.ErrorContext(r.Context(), "NewAuth", "err", err)
+		Error(w, Errorf(Unknown, "authentication is misconfigured"))
+		return nil, false
+	}
+	if a == nil {
+		return r, true
+	}
+	installLogHandler()
+
+	user, granted, err := a.authenticate(r, need)
+	if err == nil && covers(granted, need) {
+		return r.WithContext(context.WithValue(r.Context(), identityKey{}, user)), true
+	}
+	if err == nil {
+		Error(w, Errorf(Denied, "%s is not allowed %s", user, need))
+		return nil, false
+	}
+	challenge := fmt.Sprintf(`Bearer realm=%q,service=%q`, externalURL(r, "/token"), r.Host)
+	if len(need.Actions) > 0 {
+		challenge += fmt.Sprintf(",scope=%q", need.String())
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	Error(w, Errorf(Unauthorized, "%v", err))
+	return nil, false
+}
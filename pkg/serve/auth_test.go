@@ -0,0 +1,333 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAccessRules(t *testing.T) {
+	var rules []accessRule
+	for _, r := range []string{
+		"alice:*:pull,push",
+		"bob:github.com/myorg/*:pull",
+		"bob:localhost:5000/bob:*",
+		"*:public/*:pull",
+	} {
+		rule, err := parseAccessRule(r)
+		if err != nil {
+			t.Fatalf("parseAccessRule(%q): %v", r, err)
+		}
+		rules = append(rules, rule)
+	}
+	a := &Auth{rules: rules}
+	for _, c := range []struct {
+		user, repo string
+		want       []string
+	}{
+		{"alice", "anything/at/all", []string{"pull", "push"}},
+		{"bob", "github.com/myorg/repo", []string{"pull"}},
+		{"bob", "github.com/myorg/nested/repo", []string{"pull"}},
+		{"bob", "github.com/otherorg/repo", nil},
+		{"bob", "github.com/myorg", nil},
+		{"bob", "localhost:5000/bob", []string{"pull", "push"}},
+		{"bob", "localhost:5000/bob/nested", nil},
+		{"carol", "public/repo", []string{"pull"}},
+		{"carol", "github.com/myorg/repo", nil},
+	} {
+		if got := a.allowed(c.user, c.repo); !slices.Equal(got, c.want) {
+			t.Errorf("allowed(%s, %s): got %v, want %v", c.user, c.repo, got, c.want)
+		}
+	}
+
+	for _, r := range []string{"", "alice", "alice:*", ":*:pull", "alice:*:delete"} {
+		if _, err := parseAccessRule(r); err == nil {
+			t.Errorf("parseAccessRule(%q): got nil error", r)
+		}
+	}
+}
+
+func TestNewAuth(t *testing.T) {
+	for _, c := range []struct {
+		desc     string
+		users    string
+		key      string
+		wantAuth bool
+		wantErr  bool
+	}{
+		{desc: "anonymous"},
+		{desc: "with key", users: "alice:secret", key: "key", wantAuth: true},
+		{desc: "without key", users: "alice:secret", wantErr: true},
+		{desc: "invalid users", users: "alice", key: "key", wantErr: true},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			t.Setenv("AUTH_USERS", c.users)
+			t.Setenv("AUTH_TOKEN_KEY", c.key)
+			a, err := NewAuth()
+			if (err != nil) != c.wantErr || (a != nil) != c.wantAuth {
+				t.Errorf("NewAuth: got %v, %v; want auth %t, error %t", a, err, c.wantAuth, c.wantErr)
+			}
+		})
+	}
+}
+
+// testAuth returns an Auth for the users, whose passwords are their names,
+// with the access rules.
+func testAuth(t *testing.T, users []string, rules ...string) *Auth {
+	t.Helper()
+	hash := func(pass string) []byte {
+		h, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	a := &Auth{users: map[string][]byte{}, key: []byte("key"), unknownUser: hash("unknown")}
+	for _, u := range users {
+		a.users[u] = hash(u)
+	}
+	for _, r := range rules {
+		rule, err := parseAccessRule(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a
+}
+
+func TestRepositoryIsolation(t *testing.T) {
+	st := NewMemoryStorage()
+	rt := &Router{
+		Storage: st,
+		Service: "test",
+		Auth:    testAuth(t, []string{"alice", "bob"}, "alice:alice/*:*", "bob:bob/*:*"),
+		ResolveManifest: func(ctx context.Context, repo, tag string) (string, error) {
+			name := fmt.Sprintf("test-%s:%s", repo, tag)
+			if _, err := LookupTag(ctx, st, name); err != nil {
+				return "", err
+			}
+			return name, nil
+		},
+		PushManifest: func(ctx context.Context, repo, ref string, desc v1.Descriptor) error {
+			return WriteTag(ctx, st, fmt.Sprintf("test-%s:%s", repo, ref), desc, time.Time{})
+		},
+	}
+	s := httptest.NewServer(rt)
+	t.Cleanup(s.Close)
+
+	// Alice pushes an image to her repository.
+	ref, err := name.ParseReference(s.Listener.Addr().String()+"/alice/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := remote.WithAuth(&authn.Basic{Username: "alice", Password: "alice"})
+	if err := remote.Write(ref, img, alice); err != nil {
+		t.Fatalf("remote.Write: %v", err)
+	}
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ld, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf, err := img.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, err := img.MediaType()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(user, method, path string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.SetBasicAuth(user, user)
+		if body != nil {
+			req.Header.Set("Content-Type", string(mt))
+		}
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, c := range []struct {
+		desc       string
+		user       string
+		method     string
+		path       string
+		body       []byte
+		wantStatus int
+	}{
+		{"unknown user", "mallory", http.MethodGet, "/v2/alice/app/manifests/v1", nil, http.StatusUnauthorized},
+		{"pull without access", "bob", http.MethodGet, "/v2/alice/app/manifests/v1", nil, http.StatusForbidden},
+		{"push without access", "bob", http.MethodPut, "/v2/alice/app/manifests/v2", mf, http.StatusForbidden},
+		{"pull manifest by digest", "alice", http.MethodGet, "/v2/alice/app/manifests/" + d.String(), nil, http.StatusOK},
+		{"pull blob", "alice", http.MethodGet, "/v2/alice/app/blobs/" + ld.String(), nil, http.StatusOK},
+		{"pull from other repository", "alice", http.MethodGet, "/v2/alice/other/blobs/" + ld.String(), nil, http.StatusNotFound},
+		{"pull manifest across repositories", "bob", http.MethodGet, "/v2/bob/app/manifests/" + d.String(), nil, http.StatusNotFound},
+		{"pull blob across repositories", "bob", http.MethodGet, "/v2/bob/app/blobs/" + ld.String(), nil, http.StatusNotFound},
+		{"list referrers across repositories", "bob", http.MethodGet, "/v2/bob/app/referrers/" + d.String(), nil, http.StatusNotFound},
+		{"mount without access", "bob", http.MethodPost, "/v2/bob/app/blobs/uploads/?mount=" + ld.String() + "&from=alice/app", nil, http.StatusAccepted},
+		{"mount without from", "bob", http.MethodPost, "/v2/bob/app/blobs/uploads/?mount=" + ld.String(), nil, http.StatusAccepted},
+		{"push manifest across repositories", "bob", http.MethodPut, "/v2/bob/app/manifests/stolen", mf, http.StatusBadRequest},
+		{"mount", "alice", http.MethodPost, "/v2/alice/other/blobs/uploads/?mount=" + ld.String() + "&from=alice/app", nil, http.StatusCreated},
+		{"pull mounted blob", "alice", http.MethodGet, "/v2/alice/other/blobs/" + ld.String(), nil, http.StatusOK},
+	} {
+		rec := do(c.user, c.method, c.path, c.body)
+		if rec.Code >= 300 && rec.Code < 400 {
+			// Blobs may be served by redirect.
+			rec.Code = http.StatusOK
+		}
+		if rec.Code != c.wantStatus {
+			b, _ := io.ReadAll(rec.Body)
+			t.Errorf("%s: %s %s as %s: got status %d, want %d: %s", c.desc, c.method, c.path, c.user, rec.Code, c.wantStatus, b)
+		}
+	}
+}
+
+func TestLinkExpiry(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+	expires := time.Now().Add(7 * 24 * time.Hour).Truncate(time.Second)
+	rt := &Router{
+		Storage: st,
+		Service: "test",
+		Auth:    testAuth(t, []string{"alice"}, "alice:alice/*:*"),
+		ResolveManifest: func(ctx context.Context, repo, tag string) (string, error) {
+			name := fmt.Sprintf("test-%s:%s", repo, tag)
+			if _, err := LookupTag(ctx, st, name); err != nil {
+				return "", err
+			}
+			return name, nil
+		},
+		PushManifest: func(ctx context.Context, repo, ref string, desc v1.Descriptor) error {
+			return WriteTag(ctx, st, fmt.Sprintf("test-%s:%s", repo, ref), desc, expires)
+		},
+	}
+	s := httptest.NewServer(rt)
+	t.Cleanup(s.Close)
+
+	ref, err := name.ParseReference(s.Listener.Addr().String()+"/alice/app:7d", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: "alice", Password: "alice"})); err != nil {
+		t.Fatalf("remote.Write: %v", err)
+	}
+
+	// Everything the tag references is linked until the tag expires, so
+	// it can be pulled by digest after links made with age would expire.
+	names := imageNames(t, img)
+	for _, role := range []string{"manifest", "config", "layer"} {
+		h, err := v1.NewHash(names[role])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rt.linkExpiry(ctx, "alice/app", h); !got.Equal(expires) {
+			t.Errorf("%s link expires at %s, want %s", role, got, expires)
+		}
+	}
+}
+
+func TestBuildAccess(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+	rt := &Router{
+		Storage: st,
+		Service: "test",
+		Auth:    testAuth(t, []string{"alice", "bob"}, "alice:alice/*:pull", "bob:bob/*:pull"),
+	}
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		repo, ck := user+"/app", "ck-"+user
+		bctx := context.WithValue(ctx, repoKey{}, repoRef{Service: "test", Repo: repo})
+		_, l := captureLogs(bctx)
+		saveLogs(bctx, st, ck, l, nil)
+		if _, err := writeStatus(ctx, st, BuildStatus{Key: "async-" + user, Service: "test", Repo: repo, State: BuildRunning}, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteImage(ctx, st, img, ck); err != nil {
+			t.Fatal(err)
+		}
+		if err := RecordBuild(ctx, st, "test", ck, repo, nil, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Logs stored without a repository can't be attributed to one.
+	if err := st.WriteObject(ctx, logsName("ck-unknown"), `{"log":"built"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(user, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetBasicAuth(user, user)
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, c := range []struct {
+		user, path string
+		wantStatus int
+	}{
+		{"alice", "/logs/ck-alice", http.StatusOK},
+		{"bob", "/logs/ck-alice", http.StatusForbidden},
+		{"alice", "/logs/ck-unknown", http.StatusForbidden},
+		{"mallory", "/logs/ck-alice", http.StatusUnauthorized},
+		{"bob", "/status/async-bob", http.StatusOK},
+		{"alice", "/status/async-bob", http.StatusForbidden},
+		// Synchronous builds belong to the repository in their logs.
+		{"alice", "/status/ck-alice", http.StatusOK},
+		{"bob", "/status/ck-alice", http.StatusForbidden},
+	} {
+		if rec := get(c.user, c.path); rec.Code != c.wantStatus {
+			t.Errorf("GET %s as %s: got status %d, want %d: %s", c.path, c.user, rec.Code, c.wantStatus, rec.Body)
+		}
+	}
+
+	// The catalog only lists what the user can pull.
+	var cat catalog
+	if err := json.Unmarshal(get("alice", "/v2/_catalog").Body.Bytes(), &cat); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice/app"}; !slices.Equal(cat.Repositories, want) {
+		t.Errorf("/v2/_catalog as alice: got %v, want %v", cat.Repositories, want)
+	}
+	var entries struct{ Images []CatalogEntry }
+	if err := json.Unmarshal(get("bob", "/catalog").Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries.Images) != 1 || entries.Images[0].Repo != "bob/app" {
+		t.Errorf("/catalog as bob: got %+v, want only bob/app", entries.Images)
+	}
+}
@@ -0,0 +1,177 @@
+package serve
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// setBlobHeaders sets the headers describing a stored blob.
+func setBlobHeaders(w http.ResponseWriter, desc v1.Descriptor) {
+	if desc.Digest != (v1.Hash{}) {
+		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+		w.Header().Set("ETag", fmt.Sprintf("%q", desc.Digest.String()))
+	}
+	w.Header().Set("Content-Type", string(desc.MediaType))
+	w.Header().Set("Accept-Ranges", "bytes")
+}
+
+// serveObject streams the contents of a stored blob described by desc,
+// honoring HEAD, If-None-Match and single-range Range requests.
+//
+// open is called to read length bytes of the blob starting at offset; a
+// length of -1 means to read until the end.
+func serveObject(w http.ResponseWriter, r *http.Request, desc v1.Descriptor, open func(offset, length int64) (io.ReadCloser, error)) {
+	ctx := r.Context()
+	setBlobHeaders(w, desc)
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && desc.Digest != (v1.Hash{}) {
+		for _, etag := range strings.Split(inm, ",") {
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == "*" || strings.Trim(etag, `"`) == desc.Digest.String() {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	var offset, length int64 = 0, -1
+	status := http.StatusOK
+	if rh := r.Header.Get("Range"); rh != "" {
+		start, end, ok := parseRange(rh, desc.Size)
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", desc.Size))
+			http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		offset, length = start, end-start+1
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, desc.Size))
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(desc.Size, 10))
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	rc, err := open(offset, length)
+	if err != nil {
+		slog.ErrorContext(ctx, "open", "err", err)
+		w.Header().Del("Content-Length")
+		Error(w, err)
+		return
+	}
+	defer rc.Close()
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, rc); err != nil {
+		slog.ErrorContext(ctx, "io.Copy", "err", err)
+	}
+}
+
+// parseRange parses a single byte range from a Range header, returning the
+// inclusive start and end offsets. Multiple ranges aren't supported.
+func parseRange(h string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if first == "" {
+		// Suffix range, e.g., "bytes=-500" for the last 500 bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, size > 0
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+// ErrDigestMismatch is returned when the contents written to a blob don't
+// match the digest or size they were expected to have. Nothing is stored when
+// this happens.
+var ErrDigestMismatch = &RegistryError{
+	Code:    Unknown,
+	Status:  http.StatusBadGateway,
+	Message: "blob contents do not match digest",
+}
+
+// digestVerifier hashes and counts the bytes read through it, so they can be
+// checked against the expected digest and size before a write is finalized.
+type digestVerifier struct {
+	r    io.Reader
+	h    hash.Hash
+	n    int64
+	want v1.Hash
+	size int64
+}
+
+// newDigestVerifier returns a digestVerifier reading from r, expecting
+// contents with digest h and the given size. A size of -1 means the size
+// isn't known, and only the digest is checked. A zero h means the digest
+// isn't known, and only the size is checked.
+func newDigestVerifier(r io.Reader, h v1.Hash, size int64) (*digestVerifier, error) {
+	if h == (v1.Hash{}) {
+		return &digestVerifier{r: r, size: size}, nil
+	}
+	hasher, err := v1.Hasher(h.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &digestVerifier{r: r, h: hasher, want: h, size: size}, nil
+}
+
+func (v *digestVerifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if v.h != nil {
+		v.h.Write(p[:n])
+	}
+	v.n += int64(n)
+	return n, err
+}
+
+// verify returns an error wrapping ErrDigestMismatch if the contents read so
+// far don't match the expected digest and size.
+func (v *digestVerifier) verify() error {
+	if v.size >= 0 && v.n != v.size {
+		return fmt.Errorf("%w: got %d bytes, want %d", ErrDigestMismatch, v.n, v.size)
+	}
+	if v.h == nil {
+		return nil
+	}
+	got := v1.Hash{Algorithm: v.want.Algorithm, Hex: hex.EncodeToString(v.h.Sum(nil))}
+	if got != v.want {
+		return fmt.Errorf("%w: got %s, want %s", ErrDigestMismatch, got, v.want)
+	}
+	return nil
+}
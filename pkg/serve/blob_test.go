@@ -0,0 +1,93 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestParseRange(t *testing.T) {
+	for _, c := range []struct {
+		h          string
+		size       int64
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-99", 1000, 0, 99, true},
+		{"bytes=100-", 1000, 100, 999, true},
+		{"bytes=900-2000", 1000, 900, 999, true},
+		{"bytes=999-999", 1000, 999, 999, true},
+		{"bytes=-100", 1000, 900, 999, true},
+		{"bytes=-2000", 1000, 0, 999, true},
+		{"bytes= 10-20", 1000, 10, 20, true},
+		{"bytes=1000-", 1000, 0, 0, false},
+		{"bytes=20-10", 1000, 0, 0, false},
+		{"bytes=-0", 1000, 0, 0, false},
+		{"bytes=-10", 0, 0, 0, false},
+		{"bytes=0-", 0, 0, 0, false},
+		{"bytes=-", 1000, 0, 0, false},
+		{"bytes=10", 1000, 0, 0, false},
+		{"bytes=a-b", 1000, 0, 0, false},
+		{"bytes=-1-10", 1000, 0, 0, false},
+		{"bytes=0-9,20-29", 1000, 0, 0, false},
+		{"items=0-9", 1000, 0, 0, false},
+		{"", 1000, 0, 0, false},
+	} {
+		start, end, ok := parseRange(c.h, c.size)
+		if ok != c.ok || (ok && (start != c.start || end != c.end)) {
+			t.Errorf("parseRange(%q, %d): got %d, %d, %t; want %d, %d, %t", c.h, c.size, start, end, ok, c.start, c.end, c.ok)
+		}
+	}
+}
+
+func TestWriteBlobDigestMismatch(t *testing.T) {
+	contents := []byte("hello, world")
+	sum := sha256.Sum256(contents)
+	h := v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])}
+	other := v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(make([]byte, sha256.Size))}
+
+	local, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, st := range map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"local":  local,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, c := range []struct {
+				desc    string
+				h       v1.Hash
+				size    int64
+				wantErr bool
+			}{
+				{"wrong digest", other, int64(len(contents)), true},
+				{"too short", h, int64(len(contents)) + 1, true},
+				{"too long", h, int64(len(contents)) - 1, true},
+				{"wrong size without digest", v1.Hash{}, 1, true},
+				{"unknown size", h, -1, false},
+				{"match", h, int64(len(contents)), false},
+			} {
+				name := "blob-" + c.desc
+				err := st.writeBlob(ctx, name, c.h, c.size, io.NopCloser(bytes.NewReader(contents)), "application/octet-stream")
+				if c.wantErr != errors.Is(err, ErrDigestMismatch) {
+					t.Errorf("%s: writeBlob: got %v, want mismatch %t", c.desc, err, c.wantErr)
+				}
+				if !c.wantErr && err != nil {
+					t.Errorf("%s: writeBlob: %v", c.desc, err)
+				}
+				// Nothing is stored when the contents don't match.
+				if _, err := st.BlobExists(ctx, name); c.wantErr != isNotExist(err) {
+					t.Errorf("%s: BlobExists after writeBlob: got %v, want not exist %t", c.desc, err, c.wantErr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package serve
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// Each image recorded by RecordBuild is described by an object named
+// "catalog-<service>/<repo>/<key>", containing its CatalogEntry as JSON, where
+// the cache key is hashed since it can contain anything. Repositories can be
+// listed from the names alone, without reading every entry.
+//
+// Each entry is also stored under
+// "catalogdigest-<digest>/<service>/<repo>/<key>", so entries can be looked up
+// by digest without reading every entry.
+const (
+	catalogPrefix       = "catalog-"
+	catalogDigestPrefix = "catalogdigest-"
+)
+
+func catalogName(service, repo, key string) string {
+	return catalogPrefix + catalogPath(service, repo, key)
+}
+
+func catalogDigestName(d v1.Hash, service, repo, key string) string {
+	return catalogDigestPrefix + d.String() + "/" + catalogPath(service, repo, key)
+}
+
+// catalogPath is the part of an entry's names after the prefix.
+func catalogPath(service, repo, key string) string {
+	return fmt.Sprintf("%s/%s/%x", service, repo, md5.Sum([]byte(key)))
+}
+
+// parseCatalogName returns the service and repository of the entry stored
+// under name.
+func parseCatalogName(name string) (service, repo string, ok bool) {
+	rest, ok := strings.CutPrefix(name, catalogPrefix)
+	if !ok {
+		return "", "", false
+	}
+	return parseCatalogPath(rest)
+}
+
+// parseCatalogPath returns the service and repository from the part of an
+// entry's names after the prefix.
+func parseCatalogPath(rest string) (service, repo string, ok bool) {
+	service, rest, ok = strings.Cut(rest, "/")
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 {
+		return "", "", false
+	}
+	return service, rest[:i], true
+}
+
+// CatalogEntry describes an image built and cached under a cache key, so
+// that cache keys and digests can be traced back to what was requested.
+type CatalogEntry struct {
+	// Service is the service that built the image.
+	Service string `json:"service"`
+	// Key is the cache key the image is stored under.
+	Key string `json:"key"`
+	// Repo is the repository the image was requested from.
+	Repo string `json:"repo"`
+	// Inputs are the service-specific inputs to the build, like the
+	// import path and version, the packages installed, or the source
+	// image reference.
+	Inputs map[string]any `json:"inputs,omitempty"`
+
+	Digest    v1.Hash         `json:"digest"`
+	MediaType types.MediaType `json:"mediaType"`
+	// Size is the total size of the manifest and everything it
+	// references, recursively. Blobs shared by images in an index are
+	// counted once per image.
+	Size int64 `json:"size"`
+	// Built is when the image was written.
+	Built time.Time `json:"built"`
+}
+
+// RecordBuild records a CatalogEntry for the image or index d, which the
+// service built for repo and wrote under the cache key, replacing any entry
+// recorded the last time it was built, and its digest's index entry. Entries
+// expire with age, like other objects written by WriteObject.
+func RecordBuild(ctx context.Context, st Storage, service, key, repo string, inputs map[string]any, d partial.Describable) error {
+	desc, err := partial.Descriptor(d)
+	if err != nil {
+		return err
+	}
+	size, err := totalSize(d)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(CatalogEntry{
+		Service:   service,
+		Key:       key,
+		Repo:      repo,
+		Inputs:    inputs,
+		Digest:    desc.Digest,
+		MediaType: desc.MediaType,
+		Size:      size,
+		Built:     time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	name := catalogName(service, repo, key)
+	if prev, err := readCatalog(ctx, st, []string{name}); err == nil {
+		for _, n := range []string{catalogDigestName(prev[0].Digest, service, repo, key), name} {
+			if err := st.delete(ctx, n); err != nil && !isNotExist(err) {
+				return fmt.Errorf("deleting previous entry %q: %w", n, err)
+			}
+		}
+	} else if !isNotExist(err) {
+		return err
+	}
+	// The digest's entry is written first, so every entry can be found by
+	// its digest.
+	dname := catalogDigestName(desc.Digest, service, repo, key)
+	if err := st.WriteObject(ctx, dname, string(b)); err != nil {
+		return err
+	}
+	return st.WriteObject(ctx, name, string(b))
+}
+
+// totalSize returns the size of the image or index's manifest and everything
+// it references.
+func totalSize(d partial.Describable) (int64, error) {
+	switch d := d.(type) {
+	case v1.ImageIndex:
+		size, err := d.Size()
+		if err != nil {
+			return 0, err
+		}
+		im, err := d.IndexManifest()
+		if err != nil {
+			return 0, err
+		}
+		for _, desc := range im.Manifests {
+			var child partial.Describable
+			switch {
+			case desc.MediaType.IsIndex():
+				child, err = d.ImageIndex(desc.Digest)
+			case desc.MediaType.IsImage():
+				child, err = d.Image(desc.Digest)
+			default:
+				size += desc.Size
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			s, err := totalSize(child)
+			if err != nil {
+				return 0, err
+			}
+			size += s
+		}
+		return size, nil
+	case v1.Image:
+		m, err := d.Manifest()
+		if err != nil {
+			return 0, err
+		}
+		size, err := d.Size()
+		if err != nil {
+			return 0, err
+		}
+		size += m.Config.Size
+		for _, l := range m.Layers {
+			size += l.Size
+		}
+		return size, nil
+	default:
+		return 0, fmt.Errorf("unexpected %T", d)
+	}
+}
+
+// catalogNames returns the names of the entries recorded by RecordBuild for
+// the service, or for every service if it's empty, sorted. Names are listed
+// under prefix, which is catalogPrefix or a digest's catalogDigestPrefix.
+func catalogNames(ctx context.Context, st Storage, prefix, service string) ([]string, error) {
+	if service != "" {
+		prefix += service + "/"
+	}
+	objs, err := st.list(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(objs))
+	for _, o := range objs {
+		names = append(names, o.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readCatalog reads the entries stored under names, in the same order.
+func readCatalog(ctx context.Context, st Storage, names []string) ([]CatalogEntry, error) {
+	out := make([]CatalogEntry, len(names))
+	var g errgroup.Group
+	g.SetLimit(10)
+	for i, name := range names {
+		g.Go(func() error {
+			rc, err := st.readBlob(ctx, name)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			if err := json.NewDecoder(rc).Decode(&out[i]); err != nil {
+				return fmt.Errorf("reading %q: %w", name, err)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// catalog is the response to a /v2/_catalog request.
+type catalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+// serveCatalog serves the repositories of images recorded by RecordBuild for
+// the Router's Service at /v2/_catalog, paginated by paginate. If the Router
+// has no Service, repositories of every service are listed under the
+// service's name, like kontain serves them. Only repositories the user can
+// pull are listed.
+func (rt *Router) serveCatalog(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	names, err := catalogNames(ctx, rt.Storage, catalogPrefix, rt.Service)
+	if err != nil {
+		slog.ErrorContext(ctx, "listing catalog", "err", err)
+		Error(w, err)
+		return
+	}
+	repos := make([]string, 0, len(names))
+	for _, name := range names {
+		service, repo, ok := parseCatalogName(name)
+		if ref := (repoRef{Service: service, Repo: repo}); ok && rt.canPull(ctx, ref) {
+			repos = append(repos, rt.repoName(ref))
+		}
+	}
+	repos, err = paginate(w, r, repos)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	serveJSON(w, r, catalog{Repositories: repos})
+}
+
+// defaultCatalogPage is the number of entries served at /catalog if the
+// request doesn't say how many it wants.
+const defaultCatalogPage = 100
+
+// serveCatalogEntries serves the entries recorded by RecordBuild for the
+// Router's Service, or for every service if it has none, at /catalog,
+// optionally only those with the repo, key or digest given as query
+// parameters. Only entries for repositories the user can pull are served.
+// Entries are sorted by service, repo and hashed key, and paginated by
+// paginate, defaulting to defaultCatalogPage entries. Entries with a digest
+// are listed from the digest's index entries, so only those are read.
+func (rt *Router) serveCatalogEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	prefix := catalogPrefix
+	if d := q.Get("digest"); d != "" {
+		h, err := v1.NewHash(d)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid digest %q: %v", d, err), http.StatusBadRequest)
+			return
+		}
+		prefix = catalogDigestPrefix + h.String() + "/"
+	}
+	names, err := catalogNames(ctx, rt.Storage, prefix, rt.Service)
+	if err != nil {
+		slog.ErrorContext(ctx, "listing catalog", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filtered := names[:0]
+	for _, name := range names {
+		rest := strings.TrimPrefix(name, prefix)
+		service, repo, ok := parseCatalogPath(rest)
+		if !ok || !rt.canPull(ctx, repoRef{Service: service, Repo: repo}) ||
+			(q.Has("repo") && repo != q.Get("repo")) ||
+			(q.Has("key") && !strings.HasSuffix(name, fmt.Sprintf("/%x", md5.Sum([]byte(q.Get("key")))))) {
+			continue
+		}
+		filtered = append(filtered, rest)
+	}
+
+	if !q.Has("n") {
+		q.Set("n", strconv.Itoa(defaultCatalogPage))
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.RawQuery = q.Encode()
+		r = r2
+	}
+	page, err := paginate(w, r, filtered)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i, name := range page {
+		page[i] = prefix + name
+	}
+	entries, err := readCatalog(ctx, rt.Storage, page)
+	if err != nil {
+		slog.ErrorContext(ctx, "reading catalog", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveJSON(w, r, struct {
+		Images []CatalogEntry `json:"images"`
+	}{entries})
+}
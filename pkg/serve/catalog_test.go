@@ -0,0 +1,169 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestCatalog(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	od, err := other.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []struct {
+		service, key, repo string
+		img                v1.Image
+	}{
+		{"ko", "ko-1", "github.com/google/ko", img},
+		{"ko", "ko-2", "github.com/google/ko", other},
+		{"ko", "ko-3", "github.com/google/go-containerregistry/cmd/crane", img},
+		{"flatten", "flatten-1", "busybox", other},
+		// Rebuilding replaces the entry, and its digest's entry.
+		{"flatten", "flatten-1", "busybox", img},
+	} {
+		if err := RecordBuild(ctx, st, b.service, b.key, b.repo, nil, b.img); err != nil {
+			t.Fatalf("RecordBuild(%s, %s): %v", b.service, b.key, err)
+		}
+	}
+
+	get := func(t *testing.T, rt *Router, path string, v any) http.Header {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %d: %s", path, rec.Code, rec.Body)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return rec.Header()
+	}
+
+	for _, c := range []struct {
+		desc     string
+		service  string
+		path     string
+		want     []string
+		wantLink string
+	}{{
+		desc:    "service",
+		service: "ko",
+		path:    "/v2/_catalog",
+		want:    []string{"github.com/google/go-containerregistry/cmd/crane", "github.com/google/ko"},
+	}, {
+		desc: "every service",
+		path: "/v2/_catalog",
+		want: []string{"flatten/busybox", "ko/github.com/google/go-containerregistry/cmd/crane", "ko/github.com/google/ko"},
+	}, {
+		desc:     "first page",
+		path:     "/v2/_catalog?n=1",
+		want:     []string{"flatten/busybox"},
+		wantLink: `</v2/_catalog?last=flatten%2Fbusybox&n=1>; rel="next"`,
+	}, {
+		desc: "last page",
+		path: "/v2/_catalog?n=1&last=ko/github.com/google/go-containerregistry/cmd/crane",
+		want: []string{"ko/github.com/google/ko"},
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			var got catalog
+			h := get(t, &Router{Storage: st, Service: c.service}, c.path, &got)
+			if !slices.Equal(got.Repositories, c.want) {
+				t.Errorf("got %v, want %v", got.Repositories, c.want)
+			}
+			if link := h.Get("Link"); link != c.wantLink {
+				t.Errorf("got Link %q, want %q", link, c.wantLink)
+			}
+		})
+	}
+
+	for _, c := range []struct {
+		desc     string
+		service  string
+		path     string
+		wantKeys []string
+	}{{
+		desc:     "service",
+		service:  "flatten",
+		path:     "/catalog",
+		wantKeys: []string{"flatten-1"},
+	}, {
+		desc:     "by repo",
+		path:     "/catalog?repo=github.com/google/ko",
+		wantKeys: []string{"ko-1", "ko-2"},
+	}, {
+		desc:     "by key",
+		path:     "/catalog?key=ko-3",
+		wantKeys: []string{"ko-3"},
+	}, {
+		desc:     "by digest",
+		path:     "/catalog?digest=" + d.String(),
+		wantKeys: []string{"flatten-1", "ko-1", "ko-3"},
+	}, {
+		desc:     "by other digest",
+		path:     "/catalog?digest=" + od.String(),
+		wantKeys: []string{"ko-2"},
+	}, {
+		desc:     "by digest and repo",
+		path:     "/catalog?repo=github.com/google/ko&digest=" + d.String(),
+		wantKeys: []string{"ko-1"},
+	}, {
+		desc:     "by digest in service",
+		service:  "ko",
+		path:     "/catalog?digest=" + d.String(),
+		wantKeys: []string{"ko-1", "ko-3"},
+	}} {
+		t.Run("entries "+c.desc, func(t *testing.T) {
+			var got struct{ Images []CatalogEntry }
+			get(t, &Router{Storage: st, Service: c.service}, c.path, &got)
+			var keys []string
+			for _, e := range got.Images {
+				keys = append(keys, e.Key)
+			}
+			slices.Sort(keys)
+			if !slices.Equal(keys, c.wantKeys) {
+				t.Errorf("got keys %v, want %v", keys, c.wantKeys)
+			}
+		})
+	}
+
+	// Following the Link header pages through the filtered entries.
+	var keys []string
+	for path := "/catalog?repo=github.com/google/ko&n=1"; path != ""; {
+		var got struct{ Images []CatalogEntry }
+		h := get(t, &Router{Storage: st}, path, &got)
+		if len(got.Images) != 1 {
+			t.Fatalf("GET %s: got %d entries, want 1", path, len(got.Images))
+		}
+		keys = append(keys, got.Images[0].Key)
+		path = ""
+		if link := h.Get("Link"); link != "" {
+			path = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	slices.Sort(keys)
+	if want := []string{"ko-1", "ko-2"}; !slices.Equal(keys, want) {
+		t.Errorf("paging through entries: got keys %v, want %v", keys, want)
+	}
+}
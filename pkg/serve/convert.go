@@ -0,0 +1,250 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Equivalent Docker and OCI media types, in both directions.
+var (
+	toOCI = map[types.MediaType]types.MediaType{
+		types.DockerManifestList:      types.OCIImageIndex,
+		types.DockerManifestSchema2:   types.OCIManifestSchema1,
+		types.DockerConfigJSON:        types.OCIConfigJSON,
+		types.DockerLayer:             types.OCILayer,
+		types.DockerUncompressedLayer: types.OCIUncompressedLayer,
+		types.DockerForeignLayer:      types.OCIRestrictedLayer,
+	}
+	toDocker = map[types.MediaType]types.MediaType{}
+)
+
+func init() {
+	for d, o := range toOCI {
+		toDocker[o] = d
+	}
+}
+
+// accepts returns the media types accepted by the request, in order of
+// preference. If the request accepts any media type, it returns nil.
+func accepts(r *http.Request) []types.MediaType {
+	var mts []types.MediaType
+	for _, h := range r.Header.Values("Accept") {
+		for _, mt := range strings.Split(h, ",") {
+			mt, _, _ = strings.Cut(mt, ";")
+			mt = strings.TrimSpace(mt)
+			switch mt {
+			case "":
+				continue
+			case "*/*":
+				return nil
+			}
+			mts = append(mts, types.MediaType(mt))
+		}
+	}
+	return mts
+}
+
+// serveManifestBlob serves the named manifest blob from the repository in a
+// form acceptable to the client, converting it between Docker and OCI media
+// types if necessary. The manifest that's served is linked to the repository,
+// so that it and everything it references can then be fetched by digest.
+//
+// If convert is false, the manifest is only served if it's already
+// acceptable, since converting it would change its digest.
+func (rt *Router) serveManifestBlob(w http.ResponseWriter, r *http.Request, repo, name string, convert bool) {
+	ctx := r.Context()
+	desc, err := rt.Storage.BlobExists(ctx, name)
+	if err != nil {
+		slog.InfoContext(ctx, "storage.BlobExists", "name", name, "err", err)
+		Error(w, ErrNotFound)
+		return
+	}
+	send := func(cname string, h v1.Hash) {
+		// Links last as long as the tag or cache key they're made for.
+		var expires time.Time
+		if rt.restricted() {
+			if o, err := rt.Storage.stat(ctx, name); err == nil {
+				expires = o.Expires
+			}
+		}
+		if err := rt.linkManifest(ctx, repo, h, expires); err != nil {
+			slog.ErrorContext(ctx, "linkManifest", "repo", repo, "digest", h, "err", err)
+			Error(w, err)
+			return
+		}
+		rt.Storage.ServeBlob(w, r, cname)
+	}
+
+	mts := accepts(r)
+	if len(mts) == 0 {
+		send(name, desc.Digest)
+		return
+	}
+	for _, mt := range mts {
+		if mt == desc.MediaType {
+			send(name, desc.Digest)
+			return
+		}
+	}
+
+	if convert {
+		for _, mt := range mts {
+			if toOCI[desc.MediaType] != mt && toDocker[desc.MediaType] != mt {
+				continue
+			}
+			cname, err := convertManifest(ctx, rt.Storage, desc, mt)
+			if err != nil {
+				slog.InfoContext(ctx, "convertManifest", "name", name, "mediaType", mt, "err", err)
+				continue
+			}
+			cdesc, err := rt.Storage.BlobExists(ctx, cname)
+			if err != nil {
+				Error(w, err)
+				return
+			}
+			send(cname, cdesc.Digest)
+			return
+		}
+	}
+	Error(w, Errorf(ManifestUnknown, "manifest %s is not available in an acceptable media type", desc.MediaType))
+}
+
+// convertedName returns the name under which the manifest with the given
+// digest is stored after converting it to the given media type.
+func convertedName(h v1.Hash, mt types.MediaType) string {
+	if _, ok := toDocker[mt]; ok {
+		return fmt.Sprintf("oci-%s", h)
+	}
+	return fmt.Sprintf("docker-%s", h)
+}
+
+// convertManifest converts the stored manifest described by desc to the
+// given media type, including any manifests and layers it references, and
+// stores it. It returns the name of the converted manifest blob.
+func convertManifest(ctx context.Context, st Storage, desc v1.Descriptor, mt types.MediaType) (string, error) {
+	cname := convertedName(desc.Digest, mt)
+	if _, err := st.BlobExists(ctx, cname); err == nil {
+		return cname, nil
+	}
+
+	rc, err := st.readBlob(ctx, desc.Digest.String())
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+
+	_, isOCI := toDocker[mt]
+	mapping := toDocker
+	if isOCI {
+		mapping = toOCI
+	}
+	// equivalent returns the equivalent of the media type in the target
+	// format, which may be the media type itself.
+	equivalent := func(mt types.MediaType) (types.MediaType, bool) {
+		if cmt, ok := mapping[mt]; ok {
+			return cmt, true
+		}
+		for _, cmt := range mapping {
+			if cmt == mt {
+				return mt, true
+			}
+		}
+		return "", false
+	}
+	convertDesc := func(d *v1.Descriptor) error {
+		cmt, ok := equivalent(d.MediaType)
+		if !ok {
+			return fmt.Errorf("no equivalent for media type %s", d.MediaType)
+		}
+		d.MediaType = cmt
+		return nil
+	}
+
+	var out []byte
+	switch {
+	case mt.IsIndex():
+		var im v1.IndexManifest
+		if err := json.Unmarshal(b, &im); err != nil {
+			return "", err
+		}
+		if im.Subject != nil && !isOCI {
+			return "", fmt.Errorf("can't convert index with subject to %s", mt)
+		}
+		im.MediaType = mt
+		for i, m := range im.Manifests {
+			cmt, ok := equivalent(m.MediaType)
+			if !ok {
+				return "", fmt.Errorf("no equivalent for media type %s", m.MediaType)
+			}
+			if cmt == m.MediaType {
+				continue
+			}
+			child, err := st.BlobExists(ctx, m.Digest.String())
+			if err != nil {
+				return "", fmt.Errorf("child manifest %s: %w", m.Digest, err)
+			}
+			child.Digest = m.Digest
+			cname, err := convertManifest(ctx, st, child, cmt)
+			if err != nil {
+				return "", err
+			}
+			cdesc, err := st.BlobExists(ctx, cname)
+			if err != nil {
+				return "", err
+			}
+			im.Manifests[i].MediaType = cmt
+			im.Manifests[i].Digest = cdesc.Digest
+			im.Manifests[i].Size = cdesc.Size
+		}
+		if out, err = json.Marshal(im); err != nil {
+			return "", err
+		}
+	case mt.IsImage():
+		var m v1.Manifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return "", err
+		}
+		if m.Subject != nil && !isOCI {
+			return "", fmt.Errorf("can't convert manifest with subject to %s", mt)
+		}
+		m.MediaType = mt
+		if err := convertDesc(&m.Config); err != nil {
+			return "", err
+		}
+		for i := range m.Layers {
+			if err := convertDesc(&m.Layers[i]); err != nil {
+				return "", err
+			}
+		}
+		if out, err = json.Marshal(m); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("can't convert to %s", mt)
+	}
+
+	h, _, err := v1.SHA256(bytes.NewReader(out))
+	if err != nil {
+		return "", err
+	}
+	for _, n := range []string{h.String(), cname} {
+		if err := st.writeBlob(ctx, n, h, int64(len(out)), io.NopCloser(bytes.NewReader(out)), string(mt)); err != nil {
+			return "", err
+		}
+	}
+	return cname, nil
+}
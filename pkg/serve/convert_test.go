@@ -0,0 +1,216 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestConvertManifest(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+
+	img, err := random.Image(100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteImage(ctx, st, img); err != nil {
+		t.Fatal(err)
+	}
+	ociIdx, err := random.Index(100, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteIndex(ctx, st, ociIdx); err != nil {
+		t.Fatal(err)
+	}
+	dockerIdx := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.DockerManifestList), mutate.IndexAddendum{Add: img})
+	if err := WriteIndex(ctx, st, dockerIdx); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := func(d interface{ Digest() (v1.Hash, error) }) v1.Hash {
+		h, err := d.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	for _, c := range []struct {
+		desc string
+		h    v1.Hash
+		mt   types.MediaType
+		// wantChildren are the media types of the converted manifest's
+		// config and layers, or of an index's manifests.
+		wantChildren []types.MediaType
+		// wantSameDigests is whether the converted manifest references
+		// the same digests as the original.
+		wantSameDigests bool
+	}{
+		{"docker image to oci", digest(img), types.OCIManifestSchema1, []types.MediaType{types.OCIConfigJSON, types.OCILayer, types.OCILayer}, true},
+		{"oci index to docker", digest(ociIdx), types.DockerManifestList, []types.MediaType{types.DockerManifestSchema2, types.DockerManifestSchema2}, true},
+		{"docker index to oci", digest(dockerIdx), types.OCIImageIndex, []types.MediaType{types.OCIManifestSchema1}, false},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			desc, err := st.BlobExists(ctx, c.h.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			orig := manifestDescs(t, st, c.h.String(), desc.MediaType)
+
+			cname, err := convertManifest(ctx, st, desc, c.mt)
+			if err != nil {
+				t.Fatalf("convertManifest: %v", err)
+			}
+			cdesc, err := st.BlobExists(ctx, cname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cdesc.MediaType != c.mt {
+				t.Errorf("got media type %s, want %s", cdesc.MediaType, c.mt)
+			}
+			if cdesc.Digest == c.h {
+				t.Errorf("converted manifest has the original digest %s", c.h)
+			}
+			// The converted manifest is also stored by its digest, so
+			// it can be pulled by digest.
+			if d, err := st.BlobExists(ctx, cdesc.Digest.String()); err != nil || d.MediaType != c.mt {
+				t.Errorf("BlobExists(%s): got %v, %v; want media type %s", cdesc.Digest, d.MediaType, err, c.mt)
+			}
+
+			got := manifestDescs(t, st, cname, cdesc.MediaType)
+			if len(got) != len(c.wantChildren) || len(got) != len(orig) {
+				t.Fatalf("got %d descriptors, want %d", len(got), len(c.wantChildren))
+			}
+			for i, d := range got {
+				if d.MediaType != c.wantChildren[i] {
+					t.Errorf("descriptor %d: got media type %s, want %s", i, d.MediaType, c.wantChildren[i])
+				}
+				if same := d.Digest == orig[i].Digest; same != c.wantSameDigests {
+					t.Errorf("descriptor %d: got digest %s for %s, want same %t", i, d.Digest, orig[i].Digest, c.wantSameDigests)
+				}
+				if child, err := st.BlobExists(ctx, d.Digest.String()); err != nil {
+					t.Errorf("descriptor %d: BlobExists(%s): %v", i, d.Digest, err)
+				} else if c.mt.IsIndex() && child.MediaType != d.MediaType {
+					t.Errorf("descriptor %d: got stored media type %s, want %s", i, child.MediaType, d.MediaType)
+				}
+			}
+
+			// Converting again reuses the stored conversion.
+			if again, err := convertManifest(ctx, st, desc, c.mt); err != nil || again != cname {
+				t.Errorf("convertManifest again: got %q, %v; want %q", again, err, cname)
+			}
+		})
+	}
+
+	// Manifests with subjects can't be converted to Docker media types, which
+	// can't express them.
+	referrer := mutate.Subject(mutate.MediaType(empty.Image, types.OCIManifestSchema1), v1.Descriptor{
+		MediaType: types.OCIManifestSchema1,
+		Digest:    digest(img),
+	}).(v1.Image)
+	if err := WriteImage(ctx, st, referrer); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := st.BlobExists(ctx, digest(referrer).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := convertManifest(ctx, st, desc, types.DockerManifestSchema2); err == nil {
+		t.Error("convertManifest with subject to Docker: got nil error")
+	}
+}
+
+// manifestDescs returns the config and layer descriptors of the stored image
+// manifest, or the manifest descriptors of the stored index.
+func manifestDescs(t *testing.T, st Storage, name string, mt types.MediaType) []v1.Descriptor {
+	t.Helper()
+	rc, err := st.readBlob(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt.IsIndex() {
+		var im v1.IndexManifest
+		if err := json.Unmarshal(b, &im); err != nil {
+			t.Fatal(err)
+		}
+		return im.Manifests
+	}
+	var m v1.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return append([]v1.Descriptor{m.Config}, m.Layers...)
+}
+
+func TestServeManifestConversion(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteImage(ctx, st, img, "tagged"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &Router{
+		Storage: st,
+		ResolveManifest: func(ctx context.Context, repo, tag string) (string, error) {
+			return "tagged", nil
+		},
+	}
+
+	for _, c := range []struct {
+		desc       string
+		ref        string
+		accept     string
+		wantStatus int
+		wantType   types.MediaType
+		wantSame   bool
+	}{
+		{"no accept", "latest", "", http.StatusOK, types.DockerManifestSchema2, true},
+		{"any", "latest", "*/*", http.StatusOK, types.DockerManifestSchema2, true},
+		{"acceptable", "latest", "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json", http.StatusOK, types.DockerManifestSchema2, true},
+		{"convert by tag", "latest", "application/vnd.oci.image.manifest.v1+json", http.StatusOK, types.OCIManifestSchema1, false},
+		{"don't convert by digest", d.String(), "application/vnd.oci.image.manifest.v1+json", http.StatusNotFound, "", false},
+		{"no equivalent", "latest", "application/vnd.oci.image.index.v1+json", http.StatusNotFound, "", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/foo/manifests/"+c.ref, nil)
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, req)
+		if rec.Code != c.wantStatus {
+			t.Errorf("%s: got status %d, want %d: %s", c.desc, rec.Code, c.wantStatus, rec.Body)
+			continue
+		}
+		if c.wantStatus != http.StatusOK {
+			continue
+		}
+		if got := types.MediaType(rec.Header().Get("Content-Type")); got != c.wantType {
+			t.Errorf("%s: got Content-Type %s, want %s", c.desc, got, c.wantType)
+		}
+		if same := rec.Header().Get("Docker-Content-Digest") == d.String(); same != c.wantSame {
+			t.Errorf("%s: got digest %s for %s, want same %t", c.desc, rec.Header().Get("Docker-Content-Digest"), d, c.wantSame)
+		}
+	}
+}
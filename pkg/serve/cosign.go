@@ -0,0 +1,221 @@
+package serve
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Media types and annotations used by cosign signatures.
+const (
+	cosignSignatureArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	cosignSimpleSigningType     = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+)
+
+// cosignTagRE matches tags cosign uses to find artifacts attached to an
+// image, like sha256-<hex>.sig for signatures, sha256-<hex>.att for
+// attestations and sha256-<hex>.sbom for SBOMs.
+var cosignTagRE = regexp.MustCompile(`^sha256-[0-9a-f]{64}\.(sig|att|sbom)$`)
+
+// cosignTag returns the tag cosign uses to find artifacts of the given kind
+// attached to the digest, like "sig".
+func cosignTag(h v1.Hash, kind string) string {
+	return fmt.Sprintf("%s-%s.%s", h.Algorithm, h.Hex, kind)
+}
+
+// Artifacts served by cosign tags are stored as "cosign-<tag>".
+func cosignName(tag string) string { return fmt.Sprintf("cosign-%s", tag) }
+
+// NewImageSigner returns a signer using the PEM-encoded private key in the
+// file named by $SIGNING_KEY, or nil if it's not set.
+func NewImageSigner() (crypto.Signer, error) {
+	path := os.Getenv("SIGNING_KEY")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading $SIGNING_KEY: %w", err)
+	}
+	return ParseSigningKey(b)
+}
+
+// ParseSigningKey parses an unencrypted PEM-encoded ECDSA, RSA or Ed25519
+// private key, in PKCS #8, SEC 1 or PKCS #1 form.
+//
+// Keys held elsewhere, like in a KMS, can be used by passing any
+// crypto.Signer to SignImage instead.
+func ParseSigningKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// simpleSigning is the payload cosign signs, identifying the image by
+// digest.
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional"`
+}
+
+// SignImage writes a cosign-compatible signature of the image or index,
+// which is served by the sha256-<hex>.sig tag, and listed among the image's
+// referrers. Each manifest in an index is signed too, so each platform's
+// image can be verified by digest. The signature identifies the image as repo
+// by the name clients pull it by from the registry serving the request, if
+// any. If signer is nil, nothing is signed.
+//
+// Signatures are written before the image, so an image is never served by a
+// cache key without its signature.
+func SignImage(ctx context.Context, st Storage, signer crypto.Signer, repo string, d partial.Describable) error {
+	if signer == nil {
+		return nil
+	}
+	return signManifests(ctx, st, signer, externalRepo(ctx, repo), d)
+}
+
+// signManifests signs the image or index, and every manifest in an index,
+// recursively, identifying them as ref.
+func signManifests(ctx context.Context, st Storage, signer crypto.Signer, ref string, d partial.Describable) error {
+	if idx, ok := d.(v1.ImageIndex); ok {
+		im, err := idx.IndexManifest()
+		if err != nil {
+			return err
+		}
+		for _, desc := range im.Manifests {
+			var child partial.Describable
+			switch {
+			case desc.MediaType.IsIndex():
+				child, err = idx.ImageIndex(desc.Digest)
+			case desc.MediaType.IsImage():
+				child, err = idx.Image(desc.Digest)
+			default:
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := signManifests(ctx, st, signer, ref, child); err != nil {
+				return err
+			}
+		}
+	}
+	desc, err := partial.Descriptor(d)
+	if err != nil {
+		return err
+	}
+
+	var p simpleSigning
+	p.Critical.Identity.DockerReference = ref
+	p.Critical.Image.DockerManifestDigest = desc.Digest.String()
+	p.Critical.Type = "cosign container image signature"
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	sig, err := signPayload(signer, payload)
+	if err != nil {
+		return fmt.Errorf("signing %s: %w", desc.Digest, err)
+	}
+
+	img, err := mutate.Append(mutate.MediaType(empty.Image, types.OCIManifestSchema1), mutate.Addendum{
+		Layer: static.NewLayer(payload, cosignSimpleSigningType),
+		Annotations: map[string]string{
+			cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	img = mutate.ConfigMediaType(img, cosignSignatureArtifactType)
+	return Attach(ctx, st, "sig", d, img)
+}
+
+// Attach writes artifact as an attachment of the given kind to the subject,
+// like cosign does for "sig", "att" and "sbom" attachments. It's served by
+// the sha256-<hex>.<kind> tag, and its subject is set so that it's also
+// listed among the subject's referrers.
+func Attach(ctx context.Context, st Storage, kind string, subject partial.Describable, artifact v1.Image) error {
+	desc, err := partial.Descriptor(subject)
+	if err != nil {
+		return err
+	}
+	img, ok := mutate.Subject(artifact, v1.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+	}).(v1.Image)
+	if !ok {
+		return fmt.Errorf("attaching %s to %s: not an image", kind, desc.Digest)
+	}
+	return WriteImage(ctx, st, img, cosignName(cosignTag(desc.Digest, kind)))
+}
+
+// signPayload signs the payload as cosign does: Ed25519 keys sign it
+// directly, and other keys sign its SHA-256 digest.
+func signPayload(signer crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	h := sha256.Sum256(payload)
+	return signer.Sign(rand.Reader, h[:], crypto.SHA256)
+}
+
+// servePublicKey serves the PEM-encoded public key that verifies signatures.
+func (rt *Router) servePublicKey(w http.ResponseWriter, r *http.Request) {
+	b, err := x509.MarshalPKIXPublicKey(rt.Signer.Public())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: b})
+}
@@ -0,0 +1,82 @@
+package serve
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestSignImage(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := NewMemoryStorage()
+	idx, err := random.Index(100, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kontain routes /v2/ko/foo/... to the ko service as /v2/foo/...
+	ctx := context.WithValue(context.Background(), requestKey{}, &http.Request{
+		Host:       "kontain.me",
+		RequestURI: "/v2/ko/foo/manifests/latest",
+		URL:        &url.URL{Path: "/v2/foo/manifests/latest"},
+	})
+	if err := SignImage(ctx, st, key, "foo", idx); err != nil {
+		t.Fatalf("SignImage: %v", err)
+	}
+
+	d, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []v1.Hash{d}
+	for _, desc := range im.Manifests {
+		want = append(want, desc.Digest)
+	}
+	for _, h := range want {
+		var m v1.Manifest
+		if err := json.Unmarshal(readAll(t, st, cosignName(cosignTag(h, "sig"))), &m); err != nil {
+			t.Fatalf("signature of %s: %v", h, err)
+		}
+		if len(m.Layers) != 1 {
+			t.Fatalf("signature of %s: got %d layers, want 1", h, len(m.Layers))
+		}
+		var p simpleSigning
+		if err := json.Unmarshal(readAll(t, st, m.Layers[0].Digest.String()), &p); err != nil {
+			t.Fatalf("signature of %s: %v", h, err)
+		}
+		if got, want := p.Critical.Identity.DockerReference, "kontain.me/ko/foo"; got != want {
+			t.Errorf("signature of %s: got docker-reference %q, want %q", h, got, want)
+		}
+		if got := p.Critical.Image.DockerManifestDigest; got != h.String() {
+			t.Errorf("signature of %s: got docker-manifest-digest %q", h, got)
+		}
+	}
+}
+
+func readAll(t *testing.T, st Storage, name string) []byte {
+	t.Helper()
+	rc, err := st.readBlob(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
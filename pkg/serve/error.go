@@ -3,29 +3,185 @@ package serve
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 )
 
-var ErrNotFound = errors.New("repository or commit not found")
+// ErrorCode is an error code defined by the OCI distribution spec.
+type ErrorCode string
 
-func Error(w http.ResponseWriter, err error) {
-	code := "MANIFEST_UNKNOWN"
-	httpCode := http.StatusNotFound
-	if terr, ok := err.(*transport.Error); ok {
-		http.Error(w, "", terr.StatusCode)
-		json.NewEncoder(w).Encode(terr.Errors)
-		return
+const (
+	NameInvalid         ErrorCode = "NAME_INVALID"
+	NameUnknown         ErrorCode = "NAME_UNKNOWN"
+	ManifestUnknown     ErrorCode = "MANIFEST_UNKNOWN"
+	ManifestInvalid     ErrorCode = "MANIFEST_INVALID"
+	BlobUnknown         ErrorCode = "BLOB_UNKNOWN"
+	BlobUploadUnknown   ErrorCode = "BLOB_UPLOAD_UNKNOWN"
+	BlobUploadInvalid   ErrorCode = "BLOB_UPLOAD_INVALID"
+	ManifestBlobUnknown ErrorCode = "MANIFEST_BLOB_UNKNOWN"
+	SizeInvalid         ErrorCode = "SIZE_INVALID"
+	DigestInvalid       ErrorCode = "DIGEST_INVALID"
+	TagInvalid          ErrorCode = "TAG_INVALID"
+	// PaginationNumberInvalid isn't defined by the OCI distribution spec,
+	// but is served by Docker's registry for an invalid n parameter.
+	PaginationNumberInvalid ErrorCode = "PAGINATION_NUMBER_INVALID"
+	Denied                  ErrorCode = "DENIED"
+	Unauthorized            ErrorCode = "UNAUTHORIZED"
+	TooManyRequests         ErrorCode = "TOOMANYREQUESTS"
+	Unsupported             ErrorCode = "UNSUPPORTED"
+	Unavailable             ErrorCode = "UNAVAILABLE"
+	Unknown                 ErrorCode = "UNKNOWN"
+)
+
+var statusCodes = map[ErrorCode]int{
+	NameInvalid:             http.StatusBadRequest,
+	NameUnknown:             http.StatusNotFound,
+	ManifestUnknown:         http.StatusNotFound,
+	ManifestInvalid:         http.StatusBadRequest,
+	BlobUnknown:             http.StatusNotFound,
+	BlobUploadUnknown:       http.StatusNotFound,
+	BlobUploadInvalid:       http.StatusBadRequest,
+	ManifestBlobUnknown:     http.StatusBadRequest,
+	SizeInvalid:             http.StatusBadRequest,
+	DigestInvalid:           http.StatusBadRequest,
+	TagInvalid:              http.StatusBadRequest,
+	PaginationNumberInvalid: http.StatusBadRequest,
+	Denied:                  http.StatusForbidden,
+	Unauthorized:            http.StatusUnauthorized,
+	TooManyRequests:         http.StatusTooManyRequests,
+	Unsupported:             http.StatusMethodNotAllowed,
+	Unavailable:             http.StatusServiceUnavailable,
+	Unknown:                 http.StatusInternalServerError,
+}
+
+// RegistryError is an error that's served to clients with a distribution
+// spec error code and corresponding HTTP status.
+type RegistryError struct {
+	Code    ErrorCode
+	Message string
+
+	// Status overrides the HTTP status code associated with Code, if it's
+	// non-zero.
+	Status int
+
+	// RetryAfter, if non-zero, tells clients how long to wait before
+	// retrying the request.
+	RetryAfter time.Duration
+
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *RegistryError) Error() string { return e.Message }
+
+func (e *RegistryError) Unwrap() error { return e.Err }
+
+// StatusCode returns the HTTP status code to serve for the error.
+func (e *RegistryError) StatusCode() int {
+	if e.Status != 0 {
+		return e.Status
+	}
+	if s, ok := statusCodes[e.Code]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// Errorf returns a RegistryError with the given code and formatted message.
+// If the format includes a %w verb, the corresponding error is wrapped.
+func Errorf(code ErrorCode, format string, args ...any) *RegistryError {
+	err := fmt.Errorf(format, args...)
+	return &RegistryError{
+		Code:    code,
+		Message: err.Error(),
+		Err:     errors.Unwrap(err),
 	}
+}
 
-	http.Error(w, "", httpCode)
-	json.NewEncoder(w).Encode(&resp{
-		Errors: []e{{
-			Code:    code,
+// Retryable returns a RegistryError telling clients to retry the request
+// after the given duration.
+func Retryable(code ErrorCode, after time.Duration, format string, args ...any) *RegistryError {
+	e := Errorf(code, format, args...)
+	e.RetryAfter = after
+	return e
+}
+
+var ErrNotFound = &RegistryError{Code: ManifestUnknown, Message: "repository or commit not found"}
+
+// Error serves err as a distribution spec error response.
+//
+// RegistryErrors are served with their code and status. Errors from upstream
+// registries are passed through with their original status, except that an
+// upstream registry refusing access is served as DENIED with a 403 status,
+// since a 401 would tell clients to authenticate with this registry, without
+// a challenge saying how. Other errors are served as UNKNOWN with a 500
+// status.
+func Error(w http.ResponseWriter, err error) {
+	var rerr *RegistryError
+	var terr *transport.Error
+	switch {
+	case errors.As(err, &rerr):
+		if rerr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rerr.RetryAfter.Seconds()))))
+		}
+		writeError(w, rerr.StatusCode(), []e{{
+			Code:    string(rerr.Code),
 			Message: err.Error(),
-		}},
-	})
+		}})
+	case errors.As(err, &terr) && (terr.StatusCode == http.StatusUnauthorized || terr.StatusCode == http.StatusForbidden):
+		writeError(w, http.StatusForbidden, []e{{
+			Code:    string(Denied),
+			Message: fmt.Sprintf("upstream registry denied access: %v", err),
+		}})
+	case errors.As(err, &terr):
+		errs := make([]e, 0, len(terr.Errors))
+		for _, te := range terr.Errors {
+			errs = append(errs, e{
+				Code:    string(te.Code),
+				Message: te.Message,
+			})
+		}
+		if len(errs) == 0 {
+			errs = append(errs, e{
+				Code:    string(upstreamCode(terr.StatusCode)),
+				Message: err.Error(),
+			})
+		}
+		writeError(w, terr.StatusCode, errs)
+	default:
+		writeError(w, http.StatusInternalServerError, []e{{
+			Code:    string(Unknown),
+			Message: err.Error(),
+		}})
+	}
+}
+
+// upstreamCode returns the error code to use for an upstream error with the
+// given status, if the upstream registry didn't provide one.
+func upstreamCode(status int) ErrorCode {
+	switch status {
+	case http.StatusNotFound:
+		return ManifestUnknown
+	case http.StatusTooManyRequests:
+		return TooManyRequests
+	case http.StatusServiceUnavailable:
+		return Unavailable
+	default:
+		return Unknown
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, errs []e) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&resp{Errors: errs})
 }
 
 type resp struct {
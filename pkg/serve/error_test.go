@@ -0,0 +1,41 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestErrorUpstream(t *testing.T) {
+	for _, c := range []struct {
+		desc       string
+		err        error
+		wantStatus int
+		wantCode   ErrorCode
+	}{
+		{"not found", &transport.Error{StatusCode: http.StatusNotFound}, http.StatusNotFound, ManifestUnknown},
+		{"with code", &transport.Error{StatusCode: http.StatusBadRequest, Errors: []transport.Diagnostic{{Code: transport.NameInvalidErrorCode}}}, http.StatusBadRequest, NameInvalid},
+		{"unauthorized", &transport.Error{StatusCode: http.StatusUnauthorized, Errors: []transport.Diagnostic{{Code: transport.UnauthorizedErrorCode}}}, http.StatusForbidden, Denied},
+		{"forbidden", fmt.Errorf("pulling: %w", &transport.Error{StatusCode: http.StatusForbidden}), http.StatusForbidden, Denied},
+	} {
+		rec := httptest.NewRecorder()
+		Error(rec, c.err)
+		if rec.Code != c.wantStatus {
+			t.Errorf("%s: got status %d, want %d", c.desc, rec.Code, c.wantStatus)
+		}
+		var got resp
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v", c.desc, err)
+		}
+		if len(got.Errors) != 1 || got.Errors[0].Code != string(c.wantCode) {
+			t.Errorf("%s: got errors %+v, want code %s", c.desc, got.Errors, c.wantCode)
+		}
+		if h := rec.Header().Get("WWW-Authenticate"); h != "" {
+			t.Errorf("%s: got WWW-Authenticate %q, want none", c.desc, h)
+		}
+	}
+}
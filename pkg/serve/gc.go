@@ -0,0 +1,340 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// GCOptions configures CollectGarbage.
+type GCOptions struct {
+	// MaxAge is the age after which cache keys expire. Tags and other
+	// objects with an explicit expiry expire then instead.
+	MaxAge time.Duration
+
+	// Grace is how long unreachable blobs and manifests are kept after
+	// they're written, since they may belong to a cache key or tag that's
+	// still being written. If zero, DefaultGrace is used.
+	Grace time.Duration
+
+	// DryRun, if true, reports what would be deleted without deleting
+	// anything.
+	DryRun bool
+}
+
+// DefaultGrace is the default GCOptions.Grace. It's longer than any build or
+// push is allowed to run.
+const DefaultGrace = time.Hour
+
+// GCReport describes the result of CollectGarbage.
+type GCReport struct {
+	Objects   int `json:"objects"`
+	Manifests int `json:"manifests"`
+	Reachable int `json:"reachable"`
+
+	// Expired lists cache keys and manifests that were deleted because
+	// they were older than MaxAge or past their expiry, or because blobs
+	// they reference are missing.
+	Expired []string `json:"expired"`
+	// Deleted lists unreachable blobs and manifests that were deleted.
+	Deleted []string `json:"deleted"`
+	// Skipped lists manifests that couldn't be read. They're kept, but
+	// blobs only they reference may be deleted.
+	Skipped []string `json:"skipped,omitempty"`
+	// BytesFreed is the total size of all deleted objects.
+	BytesFreed int64 `json:"bytesFreed"`
+	DryRun     bool  `json:"dryRun"`
+}
+
+// CollectGarbage walks all manifests and cache keys written by Storage,
+// computes which blobs and manifests are reachable from live cache keys and
+// tags, and deletes everything else. Referrers of reachable manifests, like
+// signatures and attestations, are reachable too, and they're removed from
+// the referrers API when they're deleted.
+//
+// Liveness comes from reachability, not from when an object was written: a
+// blob shared by many images keeps the creation time of its first write, but
+// it's kept as long as any live cache key or tag references it. Cache keys
+// expire after MaxAge, and tags and other objects with an explicit expiry
+// expire then. Unreachable blobs and manifests are only kept for Grace after
+// they're written, in case they belong to a build or push that's still
+// running.
+//
+// Manifests that reference missing blobs are expired along with every cache
+// key that points to them, so clients never get a manifest whose blobs can't
+// be fetched. Cache keys are deleted before the manifests they point to, and
+// manifests before the blobs they reference.
+func CollectGarbage(ctx context.Context, st Storage, opts GCOptions) (*GCReport, error) {
+	objs, err := st.list(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing objects: %w", err)
+	}
+	rep := &GCReport{Objects: len(objs), DryRun: opts.DryRun}
+	if opts.Grace == 0 {
+		opts.Grace = DefaultGrace
+	}
+	now := time.Now()
+	cutoff := now.Add(-opts.MaxAge)
+	graceCutoff := now.Add(-opts.Grace)
+
+	byName := map[string]objectInfo{}
+	for _, o := range objs {
+		byName[o.Name] = o
+	}
+	exists := func(h v1.Hash) bool {
+		_, ok := byName[h.String()]
+		return ok
+	}
+
+	// Read the references from every stored manifest, keyed by digest.
+	// Manifests that can't be read are skipped, rather than failing the
+	// whole sweep.
+	refs := map[v1.Hash][]v1.Hash{}
+	skipped := map[v1.Hash]bool{}
+	for _, o := range objs {
+		if !isManifest(o.MediaType) || o.Digest == (v1.Hash{}) {
+			continue
+		}
+		rep.Manifests++
+		if _, ok := refs[o.Digest]; ok || skipped[o.Digest] {
+			continue
+		}
+		r, err := manifestRefs(ctx, st, o.Name, o.MediaType)
+		if err != nil {
+			slog.WarnContext(ctx, "skipping unreadable manifest", "name", o.Name, "digest", o.Digest, "err", err)
+			skipped[o.Digest] = true
+			rep.Skipped = append(rep.Skipped, o.Name)
+			continue
+		}
+		refs[o.Digest] = r
+	}
+
+	// complete reports whether a manifest and everything it references,
+	// recursively, is present. Manifests that couldn't be read are
+	// assumed complete if they exist.
+	memo := map[v1.Hash]bool{}
+	var complete func(h v1.Hash) bool
+	complete = func(h v1.Hash) bool {
+		if skipped[h] {
+			return exists(h)
+		}
+		if c, ok := memo[h]; ok {
+			return c
+		}
+		memo[h] = false // Guard against cycles.
+		r, ok := refs[h]
+		c := ok && exists(h)
+		for _, ref := range r {
+			if !c {
+				break
+			}
+			if _, isManifest := refs[ref]; isManifest || skipped[ref] {
+				c = complete(ref)
+			} else {
+				c = exists(ref)
+			}
+		}
+		memo[h] = c
+		return c
+	}
+
+	// Index the referrers of each subject, which are kept as long as their
+	// subject is.
+	referrersOf := map[v1.Hash][]v1.Hash{}
+	var indexEntries []objectInfo
+	for _, o := range objs {
+		if subject, h, ok := parseReferrerName(o.Name); ok {
+			referrersOf[subject] = append(referrersOf[subject], h)
+			indexEntries = append(indexEntries, o)
+		}
+	}
+
+	// Determine which objects to expire, and which are roots from which
+	// reachable blobs are computed.
+	expire := map[string]bool{}
+	var roots []v1.Hash
+	for _, o := range objs {
+		live := o.Created.After(cutoff)
+		if !o.Expires.IsZero() {
+			live = o.Expires.After(now)
+		}
+		switch {
+		case strings.HasPrefix(o.Name, referrersPrefixAll):
+			// Referrer index entries are deleted below along with
+			// the referrers they list.
+		case isDigest(o.Name):
+			// Blobs and manifests stored by digest are deleted below
+			// if they're unreachable. Manifests that are still being
+			// pushed are roots until their tag is written.
+			if isManifest(o.MediaType) && o.Created.After(graceCutoff) && complete(o.Digest) {
+				roots = append(roots, o.Digest)
+			}
+		case !isManifest(o.MediaType) || o.Digest == (v1.Hash{}):
+			// Other objects written by WriteObject (e.g., placeholders)
+			// just expire.
+			if !live {
+				expire[o.Name] = true
+			}
+		case skipped[o.Digest]:
+			// Keep cache keys we couldn't read until we can.
+		case !complete(o.Digest):
+			slog.InfoContext(ctx, "manifest references missing blobs", "name", o.Name, "digest", o.Digest)
+			expire[o.Name] = true
+		case !live:
+			expire[o.Name] = true
+		default:
+			roots = append(roots, o.Digest)
+		}
+	}
+	// Expire any manifest stored by digest that references missing blobs,
+	// and any cache keys pointing to expired manifests.
+	for _, o := range objs {
+		if isDigest(o.Name) && isManifest(o.MediaType) && !skipped[o.Digest] && !complete(o.Digest) {
+			slog.InfoContext(ctx, "manifest references missing blobs", "name", o.Name, "digest", o.Digest)
+			expire[o.Name] = true
+		}
+	}
+	for _, o := range objs {
+		if expire[o.Digest.String()] {
+			expire[o.Name] = true
+		}
+	}
+
+	// Mark everything reachable from the roots, including the referrers of
+	// reachable manifests, like their signatures and attestations.
+	reachable := map[string]bool{}
+	var mark func(h v1.Hash)
+	mark = func(h v1.Hash) {
+		if reachable[h.String()] {
+			return
+		}
+		reachable[h.String()] = true
+		for _, ref := range refs[h] {
+			mark(ref)
+		}
+		for _, ref := range referrersOf[h] {
+			if !expire[ref.String()] {
+				mark(ref)
+			}
+		}
+	}
+	for _, h := range roots {
+		mark(h)
+	}
+	rep.Reachable = len(reachable)
+
+	var expired, deleted []objectInfo
+	gone := map[string]bool{}
+	for _, o := range objs {
+		switch {
+		case expire[o.Name]:
+			expired = append(expired, o)
+			gone[o.Name] = true
+		case isDigest(o.Name) && !reachable[o.Name] && !skipped[o.Digest] && o.Created.Before(graceCutoff):
+			deleted = append(deleted, o)
+			gone[o.Name] = true
+		}
+	}
+	// Expire index entries whose referrer is missing or being deleted, so
+	// the referrers API never lists a manifest that can't be fetched.
+	for _, o := range indexEntries {
+		if _, h, _ := parseReferrerName(o.Name); !exists(h) || gone[h.String()] {
+			expired = append(expired, o)
+		}
+	}
+
+	// Delete cache keys first, then the manifests they point to, then
+	// unreachable manifests and blobs, so a manifest is never served
+	// without its blobs.
+	sort.SliceStable(expired, func(i, j int) bool {
+		return !isDigest(expired[i].Name) && isDigest(expired[j].Name)
+	})
+	sort.SliceStable(deleted, func(i, j int) bool {
+		return isManifest(deleted[i].MediaType) && !isManifest(deleted[j].MediaType)
+	})
+	for _, o := range expired {
+		if err := gcDelete(ctx, st, o, opts.DryRun); err != nil {
+			return rep, err
+		}
+		rep.Expired = append(rep.Expired, o.Name)
+		rep.BytesFreed += o.Size
+	}
+	for _, o := range deleted {
+		if err := gcDelete(ctx, st, o, opts.DryRun); err != nil {
+			return rep, err
+		}
+		rep.Deleted = append(rep.Deleted, o.Name)
+		rep.BytesFreed += o.Size
+	}
+	return rep, nil
+}
+
+func gcDelete(ctx context.Context, st Storage, o objectInfo, dryRun bool) error {
+	slog.InfoContext(ctx, "deleting", "name", o.Name, "created", o.Created, "size", o.Size, "dryRun", dryRun)
+	if dryRun {
+		return nil
+	}
+	if err := st.delete(ctx, o.Name); err != nil {
+		return fmt.Errorf("deleting %q: %w", o.Name, err)
+	}
+	return nil
+}
+
+// isDigest reports whether a blob name is a digest, rather than a cache key
+// or other object name.
+func isDigest(name string) bool {
+	_, err := v1.NewHash(name)
+	return err == nil
+}
+
+func isManifest(mt types.MediaType) bool {
+	return mt.IsIndex() || mt.IsImage()
+}
+
+// manifestRefs returns the digests of the blobs and manifests referenced by
+// the named manifest.
+func manifestRefs(ctx context.Context, st Storage, name string, mt types.MediaType) ([]v1.Hash, error) {
+	rc, err := st.readBlob(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return parseRefs(b, mt)
+}
+
+// parseRefs returns the digests of the blobs and manifests referenced by the
+// manifest contents.
+func parseRefs(b []byte, mt types.MediaType) ([]v1.Hash, error) {
+	var out []v1.Hash
+	if mt.IsIndex() {
+		var im v1.IndexManifest
+		if err := json.Unmarshal(b, &im); err != nil {
+			return nil, err
+		}
+		for _, m := range im.Manifests {
+			out = append(out, m.Digest)
+		}
+		return out, nil
+	}
+	var m v1.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	out = append(out, m.Config.Digest)
+	for _, l := range m.Layers {
+		out = append(out, l.Digest)
+	}
+	return out, nil
+}
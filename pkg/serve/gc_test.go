@@ -0,0 +1,262 @@
+package serve
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// backdate makes the object look like it was written age ago.
+func backdate(t *testing.T, st Storage, name string, age time.Duration) {
+	t.Helper()
+	ms := st.(*memoryStorage)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	o, ok := ms.objects[name]
+	if !ok {
+		t.Fatalf("no object %q", name)
+	}
+	o.info.Created = time.Now().Add(-age)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	const (
+		day  = 24 * time.Hour
+		ck   = "cachekey"
+		tag  = "tag"
+		ck2  = "othercachekey"
+		junk = "placeholder-cachekey"
+	)
+	for _, c := range []struct {
+		desc string
+		// setup is passed the names of the manifest, config and layer
+		// of the image written under ck.
+		setup func(t *testing.T, st Storage, manifest, config, layer string)
+		// want lists which of ck, "manifest", "config" and "layer" are
+		// kept.
+		want        []string
+		wantSkipped bool
+	}{{
+		desc: "live cache key keeps old shared blobs",
+		setup: func(t *testing.T, st Storage, manifest, config, layer string) {
+			for _, n := range []string{manifest, config, layer} {
+				backdate(t, st, n, 30*day)
+			}
+		},
+		want: []string{ck, "manifest", "config", "layer"},
+	}, {
+		desc: "expired cache key's blobs are deleted",
+		setup: func(t *testing.T, st Storage, manifest, config, layer string) {
+			for _, n := range []string{ck, manifest, config, layer} {
+				backdate(t, st, n, 2*day)
+			}
+		},
+	}, {
+		desc: "unreachable blobs are kept during the grace period",
+		setup: func(t *testing.T, st Storage, manifest, config, layer string) {
+			backdate(t, st, ck, 2*day)
+		},
+		want: []string{"manifest", "config", "layer"},
+	}, {
+		desc: "blobs reachable from an unexpired tag are kept",
+		setup: func(t *testing.T, st Storage, manifest, config, layer string) {
+			desc, err := st.BlobExists(context.Background(), manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteTag(context.Background(), st, tag, desc, time.Now().Add(7*day)); err != nil {
+				t.Fatal(err)
+			}
+			for _, n := range []string{ck, tag, manifest, config, layer} {
+				backdate(t, st, n, 2*day)
+			}
+		},
+		want: []string{"manifest", "config", "layer"},
+	}, {
+		desc: "missing blob expires the cache key",
+		setup: func(t *testing.T, st Storage, manifest, config, layer string) {
+			if err := st.delete(context.Background(), layer); err != nil {
+				t.Fatal(err)
+			}
+		},
+		want: []string{"config"},
+	}, {
+		desc: "unreadable manifest is skipped",
+		setup: func(t *testing.T, st Storage, manifest, config, layer string) {
+			ms := st.(*memoryStorage)
+			for _, n := range []string{ck, manifest} {
+				ms.objects[n].contents = []byte("not json")
+			}
+			if err := st.WriteObject(context.Background(), junk, "old"); err != nil {
+				t.Fatal(err)
+			}
+			backdate(t, st, junk, 2*day)
+		},
+		want:        []string{ck, "manifest", "config", "layer"},
+		wantSkipped: true,
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			st := NewMemoryStorage()
+			img, err := random.Image(100, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteImage(ctx, st, img, ck); err != nil {
+				t.Fatal(err)
+			}
+			names := imageNames(t, img)
+			c.setup(t, st, names["manifest"], names["config"], names["layer"])
+
+			rep, err := CollectGarbage(ctx, st, GCOptions{MaxAge: day})
+			if err != nil {
+				t.Fatalf("CollectGarbage: %v", err)
+			}
+			for _, role := range []string{ck, "manifest", "config", "layer"} {
+				n := role
+				if nn, ok := names[role]; ok {
+					n = nn
+				}
+				_, err := st.BlobExists(ctx, n)
+				if got, want := err == nil, slices.Contains(c.want, role); got != want {
+					t.Errorf("%s kept: got %t, want %t (report: %+v)", role, got, want, rep)
+				}
+			}
+			if got := len(rep.Skipped) > 0; got != c.wantSkipped {
+				t.Errorf("skipped: got %v, want skipped %t", rep.Skipped, c.wantSkipped)
+			}
+			if c.wantSkipped {
+				// The sweep carries on past unreadable manifests.
+				if _, err := st.BlobExists(ctx, junk); err == nil {
+					t.Errorf("%s was not expired", junk)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectGarbageReferrers(t *testing.T) {
+	const (
+		day = 24 * time.Hour
+		ck  = "cachekey"
+	)
+	for _, c := range []struct {
+		desc     string
+		ckAge    time.Duration
+		wantKept bool
+	}{
+		{"referrers of live images are kept", 0, true},
+		{"referrers of deleted images are deleted", 2 * day, false},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			st := NewMemoryStorage()
+			img, err := random.Image(100, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteImage(ctx, st, img, ck); err != nil {
+				t.Fatal(err)
+			}
+			d, err := img.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			referrer := mutate.Subject(mutate.MediaType(empty.Image, types.OCIManifestSchema1), v1.Descriptor{
+				MediaType: types.DockerManifestSchema2,
+				Digest:    d,
+			}).(v1.Image)
+			if err := WriteImage(ctx, st, referrer); err != nil {
+				t.Fatal(err)
+			}
+			rd, err := referrer.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry := referrersPrefix(d) + rd.String()
+
+			names, err := st.list(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, o := range names {
+				age := 30 * day
+				if o.Name == ck {
+					age = c.ckAge
+				}
+				backdate(t, st, o.Name, age)
+			}
+
+			rep, err := CollectGarbage(ctx, st, GCOptions{MaxAge: day})
+			if err != nil {
+				t.Fatalf("CollectGarbage: %v", err)
+			}
+			for _, n := range []string{rd.String(), entry} {
+				if _, err := st.BlobExists(ctx, n); (err == nil) != c.wantKept {
+					t.Errorf("%s kept: got %v, want kept %t (report: %+v)", n, err, c.wantKept, rep)
+				}
+			}
+		})
+	}
+
+	// Index entries whose referrer is gone are deleted, even if their subject
+	// is live.
+	ctx := context.Background()
+	st := NewMemoryStorage()
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteImage(ctx, st, img, ck); err != nil {
+		t.Fatal(err)
+	}
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("0", 64)}
+	if err := addReferrer(ctx, st, d, v1.Descriptor{MediaType: types.OCIManifestSchema1, Digest: missing}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CollectGarbage(ctx, st, GCOptions{MaxAge: day}); err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if _, err := st.BlobExists(ctx, referrersPrefix(d)+missing.String()); !isNotExist(err) {
+		t.Errorf("index entry for missing referrer: got %v, want not exist", err)
+	}
+}
+
+// imageNames returns the names of the image's manifest, config and only
+// layer.
+func imageNames(t *testing.T, img v1.Image) map[string]string {
+	t.Helper()
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cd, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ld, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]string{
+		"manifest": d.String(),
+		"config":   cd.String(),
+		"layer":    ld.String(),
+	}
+}
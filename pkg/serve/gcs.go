@@ -0,0 +1,303 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+type gcsStorage struct {
+	client *storage.Client
+	bucket string
+	proxy  bool
+
+	signer URLSigner
+	expiry time.Duration
+}
+
+// GCSOption configures a GCS-backed Storage.
+type GCSOption func(*gcsStorage)
+
+// WithProxy configures the Storage to stream blob contents through the
+// service instead of redirecting clients to the bucket. This allows the
+// bucket to be private, and clients to only talk to the registry host.
+func WithProxy(proxy bool) GCSOption {
+	return func(s *gcsStorage) { s.proxy = proxy }
+}
+
+// WithSignedURLs configures the Storage to redirect clients to URLs signed
+// by signer, which expire after expiry. This allows the bucket to be private
+// while still serving blobs by redirecting.
+func WithSignedURLs(signer URLSigner, expiry time.Duration) GCSOption {
+	return func(s *gcsStorage) {
+		s.signer = signer
+		s.expiry = expiry
+	}
+}
+
+// NewGCSStorage returns a Storage backed by the named GCS bucket. By default,
+// blobs are served by redirecting to the bucket, which must be publicly
+// readable.
+func NewGCSStorage(ctx context.Context, bucket string, opts ...GCSOption) (Storage, error) {
+	if bucket == "" {
+		return nil, errors.New("no bucket specified")
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("NewClient: %v", err)
+	}
+	s := &gcsStorage{client: client, bucket: bucket}
+	for _, o := range opts {
+		o(s)
+	}
+	return s, nil
+}
+
+func (s *gcsStorage) object(name string) *storage.ObjectHandle {
+	return s.client.Bucket(s.bucket).Object(fmt.Sprintf("blobs/%s", name))
+}
+
+func (s *gcsStorage) ServeBlob(w http.ResponseWriter, r *http.Request, name string) {
+	ctx := r.Context()
+
+	// HEAD requests are always answered directly, and GET requests are
+	// redirected to the bucket unless we're proxying.
+	if r.Method == http.MethodGet && !s.proxy {
+		url := fmt.Sprintf("https://storage.googleapis.com/%s/blobs/%s", s.bucket, name)
+		if s.signer != nil {
+			var err error
+			url, err = s.signer.SignURL(ctx, fmt.Sprintf("blobs/%s", name), s.expiry)
+			if err != nil {
+				slog.ErrorContext(ctx, "SignURL", "name", name, "err", err)
+				Error(w, err)
+				return
+			}
+		}
+		http.Redirect(w, r, url, http.StatusSeeOther)
+		return
+	}
+
+	desc, err := s.BlobExists(ctx, name)
+	if err != nil {
+		slog.ErrorContext(ctx, "BlobExists", "name", name, "err", err)
+		Error(w, Errorf(BlobUnknown, "blob %q not found", name))
+		return
+	}
+	serveObject(w, r, desc, func(offset, length int64) (io.ReadCloser, error) {
+		return s.object(name).NewRangeReader(ctx, offset, length)
+	})
+}
+
+func (s *gcsStorage) BlobExists(ctx context.Context, name string) (v1.Descriptor, error) {
+	obj, err := s.object(name).Attrs(ctx)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	var h v1.Hash
+	if d := obj.Metadata["Docker-Content-Digest"]; d != "" {
+		h, err = v1.NewHash(d)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+	}
+
+	return v1.Descriptor{
+		Digest:    h,
+		MediaType: types.MediaType(obj.ContentType),
+		Size:      obj.Size,
+	}, nil
+}
+
+func (s *gcsStorage) WriteObject(ctx context.Context, name, contents string) error {
+	return ignoreExists(s.createObject(ctx, name, contents))
+}
+
+func (s *gcsStorage) createObject(ctx context.Context, name, contents string) error {
+	w := s.object(name).
+		If(storage.Conditions{DoesNotExist: true}).
+		NewWriter(ctx)
+	if _, err := fmt.Fprintln(w, contents); err != nil {
+		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
+			return errExists
+		}
+		return fmt.Errorf("fmt.Fprintln: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
+			return errExists
+		}
+		return fmt.Errorf("w.Close: %v", err)
+	}
+	return nil
+}
+
+func (s *gcsStorage) putObject(ctx context.Context, name, contents string, generation int64) (int64, error) {
+	cond := storage.Conditions{GenerationMatch: generation}
+	if generation == 0 {
+		cond = storage.Conditions{DoesNotExist: true}
+	}
+	w := s.object(name).If(cond).NewWriter(ctx)
+	w.ObjectAttrs.ContentType = "text/plain; charset=utf-8"
+	if _, err := fmt.Fprintln(w, contents); err != nil {
+		return 0, preconditionErr(err, errConflict)
+	}
+	if err := w.Close(); err != nil {
+		return 0, preconditionErr(err, errConflict)
+	}
+	return w.Attrs().Generation, nil
+}
+
+func (s *gcsStorage) readObject(ctx context.Context, name string) (string, int64, error) {
+	r, err := s.object(name).NewReader(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", 0, err
+	}
+	return strings.TrimSuffix(string(b), "\n"), r.Attrs.Generation, nil
+}
+
+func (s *gcsStorage) deleteIf(ctx context.Context, name string, generation int64) error {
+	err := s.object(name).If(storage.Conditions{GenerationMatch: generation}).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return errConflict
+	}
+	return preconditionErr(err, errConflict)
+}
+
+// preconditionErr returns perr if err is a failed precondition, and err
+// otherwise.
+func preconditionErr(err, perr error) error {
+	var herr *googleapi.Error
+	if errors.As(err, &herr) && herr.Code == http.StatusPreconditionFailed {
+		return perr
+	}
+	return err
+}
+
+func (s *gcsStorage) readBlob(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.object(name).NewReader(ctx)
+}
+
+func (s *gcsStorage) stat(ctx context.Context, name string) (objectInfo, error) {
+	obj, err := s.object(name).Attrs(ctx)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	return objectInfoFromAttrs(obj), nil
+}
+
+func (s *gcsStorage) list(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var out []objectInfo
+	it := s.client.Bucket(s.bucket).Objects(ctx, &storage.Query{Prefix: "blobs/" + prefix})
+	for {
+		obj, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, objectInfoFromAttrs(obj))
+	}
+	return out, nil
+}
+
+func objectInfoFromAttrs(obj *storage.ObjectAttrs) objectInfo {
+	var h v1.Hash
+	if d := obj.Metadata["Docker-Content-Digest"]; d != "" {
+		h, _ = v1.NewHash(d)
+	}
+	return objectInfo{
+		Name:    strings.TrimPrefix(obj.Name, "blobs/"),
+		Created: obj.Created,
+		Expires: obj.CustomTime,
+		Descriptor: v1.Descriptor{
+			Digest:    h,
+			MediaType: types.MediaType(obj.ContentType),
+			Size:      obj.Size,
+		},
+	}
+}
+
+func (s *gcsStorage) delete(ctx context.Context, name string) error {
+	return s.object(name).Delete(ctx)
+}
+
+// setExpiry records the expiry as the object's custom time, which can also
+// be used by the bucket's lifecycle rules.
+func (s *gcsStorage) setExpiry(ctx context.Context, name string, t time.Time) error {
+	_, err := s.object(name).Update(ctx, storage.ObjectAttrsToUpdate{CustomTime: t})
+	return err
+}
+
+func (s *gcsStorage) writeBlob(ctx context.Context, name string, h v1.Hash, size int64, rc io.ReadCloser, contentType string) error {
+	start := time.Now()
+	defer func() { log.Printf("writeBlob(%q) took %s", name, time.Since(start)) }()
+	defer rc.Close()
+
+	v, err := newDigestVerifier(rc, h, size)
+	if err != nil {
+		return err
+	}
+	// Cancelling the writer's context aborts the upload.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The DoesNotExist precondition can be hit when writing or flushing
+	// data, which can happen any of three places. Anywhere it happens,
+	// just ignore the error since that means the blob already exists.
+	w := s.object(name).
+		If(storage.Conditions{DoesNotExist: true}).
+		NewWriter(wctx)
+	w.ObjectAttrs.ContentType = contentType
+	if h != (v1.Hash{}) {
+		w.Metadata = map[string]string{"Docker-Content-Digest": h.String()}
+	}
+	if _, err := io.Copy(w, v); err != nil {
+		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
+			return nil
+		}
+		return fmt.Errorf("Copy: %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
+			return nil
+		}
+		return fmt.Errorf("rc.Close: %v", err)
+	}
+	if err := v.verify(); err != nil {
+		cancel()
+		// The upload may have been finalized before it was cancelled.
+		// If so, delete the generation this writer created.
+		if w.Close() == nil && w.Attrs() != nil {
+			if derr := s.object(name).If(storage.Conditions{GenerationMatch: w.Attrs().Generation}).Delete(ctx); derr != nil && !errors.Is(derr, storage.ErrObjectNotExist) {
+				return fmt.Errorf("writing %q: %w; deleting it: %v", name, err, derr)
+			}
+		}
+		return fmt.Errorf("writing %q: %w", name, err)
+	}
+	if err := w.Close(); err != nil {
+		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
+			return nil
+		}
+		return fmt.Errorf("w.Close: %v", err)
+	}
+	blobBytesWritten.Observe(float64(v.n))
+	return nil
+}
@@ -0,0 +1,117 @@
+package serve
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// knownBlobTTL is how long a blob is remembered to exist in Storage
+	// without checking again. It's well under the age at which unreachable
+	// blobs are garbage collected.
+	knownBlobTTL = 10 * time.Minute
+
+	// maxKnownBlobs bounds the size of the known blob cache.
+	maxKnownBlobs = 100000
+)
+
+// known remembers which blobs were recently found in, or written to, Storage.
+var known = &knownBlobs{m: map[v1.Hash]time.Time{}}
+
+type knownBlobs struct {
+	mu sync.Mutex
+	m  map[v1.Hash]time.Time
+
+	// Total bytes and time spent writing layers, used to estimate the time
+	// saved by skipping them.
+	bytesWritten, nanosWritten atomic.Int64
+}
+
+func (k *knownBlobs) has(h v1.Hash) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	t, ok := k.m[h]
+	if ok && time.Since(t) > knownBlobTTL {
+		delete(k.m, h)
+		return false
+	}
+	return ok
+}
+
+func (k *knownBlobs) add(h v1.Hash) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.m) >= maxKnownBlobs {
+		// Rather than tracking recency, just start over.
+		clear(k.m)
+	}
+	k.m[h] = time.Now()
+}
+
+func (k *knownBlobs) forget(h v1.Hash) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.m, h)
+}
+
+// observeWrite records the time taken to write a layer of the given size.
+func (k *knownBlobs) observeWrite(size int64, d time.Duration) {
+	k.bytesWritten.Add(size)
+	k.nanosWritten.Add(int64(d))
+}
+
+// estimateSaved estimates how long it would have taken to write size bytes,
+// based on the throughput of writes observed so far.
+func (k *knownBlobs) estimateSaved(size int64) time.Duration {
+	b, n := k.bytesWritten.Load(), k.nanosWritten.Load()
+	if b == 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / float64(b) * float64(n))
+}
+
+// missingBlobs checks which of the digests are not already in Storage,
+// consulting the known blob cache first and checking the rest concurrently.
+func missingBlobs(ctx context.Context, st Storage, digests []v1.Hash) map[v1.Hash]bool {
+	var mu sync.Mutex
+	missing := map[v1.Hash]bool{}
+	var g errgroup.Group
+	g.SetLimit(20)
+	for _, h := range digests {
+		if known.has(h) {
+			continue
+		}
+		h := h
+		g.Go(func() error {
+			if _, err := st.BlobExists(ctx, h.String()); err != nil {
+				mu.Lock()
+				missing[h] = true
+				mu.Unlock()
+				return nil
+			}
+			known.add(h)
+			return nil
+		})
+	}
+	_ = g.Wait() // Errors are recorded as missing blobs.
+	return missing
+}
+
+// reportSkipped logs and records metrics about layers that weren't written
+// because they were already stored.
+func reportSkipped(ctx context.Context, n int, bytes int64) {
+	if n == 0 {
+		return
+	}
+	saved := known.estimateSaved(bytes)
+	layersSkipped.Add(float64(n))
+	layerBytesSkipped.Add(float64(bytes))
+	layerSecondsSaved.Add(saved.Seconds())
+	slog.InfoContext(ctx, "skipped writing existing layers", "layers", n, "bytes", bytes, "estimatedTimeSaved", saved)
+}
@@ -0,0 +1,235 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// leaseDuration is how long a build lease is held without being
+	// renewed before other instances assume the build has failed and take
+	// over.
+	leaseDuration = 2 * time.Minute
+
+	// leaseRenewInterval is how often the builder renews its lease while
+	// the build runs.
+	leaseRenewInterval = leaseDuration / 4
+
+	// leasePollInterval is how often instances waiting for another
+	// instance's build check whether it's done.
+	leasePollInterval = 2 * time.Second
+)
+
+var builds singleflight.Group
+
+// Build ensures that the manifest for the cache key ck has been written to
+// Storage, calling build to build and write it if it hasn't.
+//
+// Concurrent calls for the same cache key in this process share a single
+// call to build. Across instances, the builder holds a lease object in
+// Storage while it builds, renewing it periodically, and other instances poll
+// until the lease is released instead of building the same image again. If
+// the builder dies, its lease expires within two minutes and one of the
+// waiting instances takes over.
+//
+// The build continues even if ctx is cancelled, so that its result is cached
+// for the next request.
+//
+// If the request being served is subject to a build rate limit, the client
+// is charged for the build if it's the one that runs it, and gets a
+// TOOMANYREQUESTS error instead if it's exceeded its budget. Clients served
+// from the cache or by another client's build aren't charged.
+func Build(ctx context.Context, st Storage, ck string, build func(ctx context.Context) error) error {
+	for {
+		leader := false
+		ch := builds.DoChan(ck, func() (any, error) {
+			leader = true
+			return nil, buildWithLease(context.WithoutCancel(ctx), st, ck, build)
+		})
+		select {
+		case res := <-ch:
+			var cerr *chargeError
+			if !leader && errors.As(res.Err, &cerr) {
+				// The client that would have built the image is
+				// over its budget, which isn't this client's
+				// problem; try to build it again.
+				continue
+			}
+			if !leader {
+				buildResults.WithLabelValues("shared").Inc()
+			}
+			return res.Err
+		case <-ctx.Done():
+			return Retryable(Unavailable, leasePollInterval, "build of %s is still in progress", ck)
+		}
+	}
+}
+
+// chargeError is returned by buildWithLease when the client that would run
+// the build has exceeded its budget.
+type chargeError struct{ error }
+
+func (e *chargeError) Unwrap() error { return e.error }
+
+func buildWithLease(ctx context.Context, st Storage, ck string, build func(ctx context.Context) error) error {
+	lease := leaseName(ck)
+	waited := false
+	for {
+		if err := VerifyManifest(ctx, st, ck); err == nil {
+			if waited {
+				buildResults.WithLabelValues("waited").Inc()
+			} else {
+				buildResults.WithLabelValues("cached").Inc()
+			}
+			return nil
+		}
+
+		gen, err := st.putObject(ctx, lease, leaseExpiry(), 0)
+		if err == nil {
+			// BuildAsync already charged for asynchronous builds.
+			if _, async := ctx.Value(buildKey{}).(asyncBuild); !async {
+				if err := ChargeBuild(ctx); err != nil {
+					if err := st.deleteIf(ctx, lease, gen); err != nil {
+						slog.WarnContext(ctx, "releasing build lease", "lease", lease, "err", err)
+					}
+					return &chargeError{err}
+				}
+			}
+			return buildLeased(ctx, st, ck, lease, gen, build)
+		} else if !errors.Is(err, errConflict) {
+			return fmt.Errorf("acquiring build lease: %w", err)
+		}
+
+		// Another instance holds the lease; wait for it to release it,
+		// then check again whether the manifest was written.
+		slog.InfoContext(ctx, "waiting for build lease", "lease", lease)
+		waited = true
+		if err := waitForLease(ctx, st, lease); err != nil {
+			return err
+		}
+	}
+}
+
+func leaseName(ck string) string { return fmt.Sprintf("lease-%s", ck) }
+
+// leaseHeld reports whether any instance holds the build lease for the cache
+// key.
+func leaseHeld(ctx context.Context, st Storage, ck string) bool {
+	_, err := st.BlobExists(ctx, leaseName(ck))
+	return err == nil
+}
+
+// buildLeased calls build while holding the lease at generation gen,
+// renewing the lease until the build is done and then releasing it.
+func buildLeased(ctx context.Context, st Storage, ck, lease string, gen int64, build func(ctx context.Context) error) error {
+	renewed := make(chan int64, 1)
+	stop := make(chan struct{})
+	go func() {
+		renewed <- renewLease(ctx, st, lease, gen, stop)
+	}()
+	defer func() {
+		close(stop)
+		gen := <-renewed
+		// Only release the lease if we still hold it.
+		if err := st.deleteIf(ctx, lease, gen); err != nil {
+			slog.WarnContext(ctx, "releasing build lease", "lease", lease, "err", err)
+		}
+	}()
+	slog.InfoContext(ctx, "acquired build lease", "lease", lease)
+
+	// Capture the build's logs, and store them where they're served at
+	// /logs/<cache key>.
+	bctx, logs := captureLogs(ctx)
+	slog.InfoContext(bctx, "building", "ck", ck)
+	err := build(bctx)
+	url := saveLogs(ctx, st, ck, logs, err)
+	if err != nil {
+		buildResults.WithLabelValues("failed").Inc()
+		return fmt.Errorf("%w (build logs: %s)", err, url)
+	}
+	buildResults.WithLabelValues("built").Inc()
+	return nil
+}
+
+// renewLease extends the lease every leaseRenewInterval until stop is
+// closed, and returns its latest generation. If the lease is taken over by
+// another instance, it stops renewing it.
+func renewLease(ctx context.Context, st Storage, lease string, gen int64, stop <-chan struct{}) int64 {
+	t := time.NewTicker(leaseRenewInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return gen
+		case <-t.C:
+		}
+		g, err := st.putObject(ctx, lease, leaseExpiry(), gen)
+		switch {
+		case errors.Is(err, errConflict):
+			slog.WarnContext(ctx, "build lease was taken over", "lease", lease)
+			<-stop
+			return gen
+		case err != nil:
+			// Try again next tick; the lease doesn't expire until
+			// several renewals have failed.
+			slog.WarnContext(ctx, "renewing build lease", "lease", lease, "err", err)
+		default:
+			gen = g
+		}
+	}
+}
+
+// waitForLease polls until the lease is released, or until it expires, in
+// which case it's deleted so that the caller can try to take it over. If the
+// lease can't be read, it's read again rather than assumed to have expired.
+func waitForLease(ctx context.Context, st Storage, lease string) error {
+	for {
+		contents, gen, err := st.readObject(ctx, lease)
+		switch {
+		case isNotExist(err):
+			// The lease was released; the caller should check for
+			// the result, and try to acquire it if there isn't one.
+			return nil
+		case err != nil:
+			slog.WarnContext(ctx, "reading build lease", "lease", lease, "err", err)
+		default:
+			expires, err := time.Parse(time.RFC3339, strings.TrimSpace(contents))
+			if err != nil {
+				// The lease is corrupt, and will never be
+				// renewed with a valid expiry.
+				slog.WarnContext(ctx, "parsing build lease", "lease", lease, "err", err)
+			}
+			if err != nil || time.Now().After(expires) {
+				// Only one waiter deletes this generation of the
+				// lease; the others see a conflict, and all of
+				// them race to create a new one.
+				if err := st.deleteIf(ctx, lease, gen); err == nil {
+					slog.WarnContext(ctx, "build lease expired; taking over", "lease", lease, "expired", expires)
+					leaseTakeovers.Inc()
+				} else if !errors.Is(err, errConflict) {
+					slog.WarnContext(ctx, "deleting expired build lease", "lease", lease, "err", err)
+					break
+				}
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(leasePollInterval):
+		}
+	}
+}
+
+// leaseExpiry returns the contents of a lease that expires leaseDuration from
+// now.
+func leaseExpiry() string {
+	return time.Now().Add(leaseDuration).Format(time.RFC3339)
+}
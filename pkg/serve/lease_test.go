@@ -0,0 +1,166 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGenerationPreconditions(t *testing.T) {
+	local, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, st := range map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"local":  local,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			gen, err := st.putObject(ctx, "obj", "one", 0)
+			if err != nil {
+				t.Fatalf("putObject: %v", err)
+			}
+			for _, c := range []struct {
+				desc string
+				op   func() error
+				want error
+			}{{
+				desc: "create existing",
+				op:   func() error { _, err := st.putObject(ctx, "obj", "two", 0); return err },
+				want: errConflict,
+			}, {
+				desc: "replace stale generation",
+				op:   func() error { _, err := st.putObject(ctx, "obj", "two", gen+1); return err },
+				want: errConflict,
+			}, {
+				desc: "delete stale generation",
+				op:   func() error { return st.deleteIf(ctx, "obj", gen+1) },
+				want: errConflict,
+			}, {
+				desc: "delete missing",
+				op:   func() error { return st.deleteIf(ctx, "missing", 1) },
+				want: errConflict,
+			}} {
+				if err := c.op(); !errors.Is(err, c.want) {
+					t.Errorf("%s: got %v, want %v", c.desc, err, c.want)
+				}
+			}
+
+			next, err := st.putObject(ctx, "obj", "two", gen)
+			if err != nil {
+				t.Fatalf("putObject: %v", err)
+			}
+			if next == gen {
+				t.Errorf("putObject: generation didn't change")
+			}
+			if got, g, err := st.readObject(ctx, "obj"); err != nil || got != "two" || g != next {
+				t.Errorf("readObject: got %q, %d, %v; want %q, %d", got, g, err, "two", next)
+			}
+			if err := st.deleteIf(ctx, "obj", gen); !errors.Is(err, errConflict) {
+				t.Errorf("deleteIf(old generation): got %v, want %v", err, errConflict)
+			}
+			if err := st.deleteIf(ctx, "obj", next); err != nil {
+				t.Errorf("deleteIf: %v", err)
+			}
+			if _, _, err := st.readObject(ctx, "obj"); !isNotExist(err) {
+				t.Errorf("readObject after deleteIf: got %v, want not exist", err)
+			}
+		})
+	}
+}
+
+// flakyStorage fails to read objects.
+type flakyStorage struct{ Storage }
+
+func (flakyStorage) readObject(ctx context.Context, name string) (string, int64, error) {
+	return "", 0, errors.New("googleapi: Error 503: backend error")
+}
+
+func TestWaitForLease(t *testing.T) {
+	for _, c := range []struct {
+		desc     string
+		contents string // If empty, there is no lease.
+		flaky    bool
+		wantErr  bool
+		wantKept bool
+	}{{
+		desc: "released",
+	}, {
+		desc:     "expired",
+		contents: time.Now().Add(-time.Second).Format(time.RFC3339),
+	}, {
+		desc:     "corrupt",
+		contents: "not a time",
+	}, {
+		desc:     "held",
+		contents: time.Now().Add(time.Hour).Format(time.RFC3339),
+		wantErr:  true,
+		wantKept: true,
+	}, {
+		desc:     "unreadable",
+		contents: time.Now().Add(-time.Second).Format(time.RFC3339),
+		flaky:    true,
+		wantErr:  true,
+		wantKept: true,
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			t.Parallel()
+			mem := NewMemoryStorage()
+			var st Storage = mem
+			if c.flaky {
+				st = flakyStorage{mem}
+			}
+			if c.contents != "" {
+				if _, err := mem.putObject(context.Background(), "lease", c.contents, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*leasePollInterval/2)
+			defer cancel()
+			if err := waitForLease(ctx, st, "lease"); (err != nil) != c.wantErr {
+				t.Errorf("waitForLease: got %v, want error %t", err, c.wantErr)
+			}
+			if _, err := mem.BlobExists(context.Background(), "lease"); (err == nil) != c.wantKept {
+				t.Errorf("lease kept: got %t, want %t", err == nil, c.wantKept)
+			}
+		})
+	}
+}
+
+func TestLeaseTakeover(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+	if _, err := st.putObject(ctx, "lease", time.Now().Add(-time.Second).Format(time.RFC3339), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both waiters see the same expired generation, but only one of them
+	// deletes it, and only one of them acquires the new lease.
+	_, gen, err := st.readObject(ctx, "lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.deleteIf(ctx, "lease", gen); err != nil {
+		t.Fatalf("first deleteIf: %v", err)
+	}
+	if _, err := st.putObject(ctx, "lease", leaseExpiry(), 0); err != nil {
+		t.Fatalf("first putObject: %v", err)
+	}
+	if err := st.deleteIf(ctx, "lease", gen); !errors.Is(err, errConflict) {
+		t.Errorf("second deleteIf: got %v, want %v", err, errConflict)
+	}
+	if _, err := st.putObject(ctx, "lease", leaseExpiry(), 0); !errors.Is(err, errConflict) {
+		t.Errorf("second putObject: got %v, want %v", err, errConflict)
+	}
+
+	// A builder whose lease was taken over doesn't release the new one.
+	if err := buildLeased(ctx, st, "ck", "lease", gen, func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("buildLeased: %v", err)
+	}
+	if _, err := st.BlobExists(ctx, "lease"); err != nil {
+		t.Errorf("new lease was released: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package serve
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Blobs and manifests are stored by digest, shared by every repository, so
+// when access rules restrict who can pull which repositories, a digest is only
+// served from repositories it's linked to. Each link is an object named
+// "repo-<service>/<repo>-<digest>", where the service and repo are hashed
+// since the repo can contain slashes. Links are made when a manifest is served
+// by tag, for the manifest and everything it references, and when a blob or
+// manifest is pushed or mounted. Links made for a tag or cache key that
+// expires, like a ttl tag, expire when it does, so its image can be pulled by
+// digest for as long as it can be pulled by tag. Other links expire with age,
+// like other objects written by WriteObject, and are made again the next time
+// the manifest is served by tag.
+func linkName(service, repo string, h v1.Hash) string {
+	return fmt.Sprintf("repo-%x-%s", md5.Sum([]byte(service+"/"+repo)), h)
+}
+
+// restricted reports whether the Router's access rules restrict which
+// repositories users can pull, so that digests must be linked to the
+// repository they're served from.
+func (rt *Router) restricted() bool {
+	a, err := rt.auth()
+	return err == nil && a != nil && len(a.rules) > 0
+}
+
+// linked reports whether the digest can be served from the repository.
+func (rt *Router) linked(ctx context.Context, repo string, h v1.Hash) bool {
+	if !rt.restricted() {
+		return true
+	}
+	_, err := rt.Storage.BlobExists(ctx, linkName(rt.Service, repo, h))
+	return err == nil
+}
+
+// linkExpiry returns when the digest's link to the repository expires, or
+// zero if it only expires with age or isn't linked.
+func (rt *Router) linkExpiry(ctx context.Context, repo string, h v1.Hash) time.Time {
+	o, err := rt.Storage.stat(ctx, linkName(rt.Service, repo, h))
+	if err != nil {
+		return time.Time{}
+	}
+	return o.Expires
+}
+
+// linkedUntil reports whether the digest is linked to the repository until at
+// least expires, or at all if expires is zero.
+func (rt *Router) linkedUntil(ctx context.Context, repo string, h v1.Hash, expires time.Time) bool {
+	o, err := rt.Storage.stat(ctx, linkName(rt.Service, repo, h))
+	if err != nil {
+		return false
+	}
+	return expires.IsZero() || (!o.Expires.IsZero() && !o.Expires.Before(expires))
+}
+
+// link links the digest to the repository, if it's restricted. If expires is
+// non-zero, the link lasts until then, or longer if it already did.
+func (rt *Router) link(ctx context.Context, repo string, h v1.Hash, expires time.Time) error {
+	if !rt.restricted() {
+		return nil
+	}
+	name := linkName(rt.Service, repo, h)
+	if err := ignoreExists(rt.Storage.createObject(ctx, name, h.String())); err != nil {
+		return err
+	}
+	if expires.IsZero() || rt.linkedUntil(ctx, repo, h, expires) {
+		return nil
+	}
+	return rt.Storage.setExpiry(ctx, name, expires)
+}
+
+// linkManifest links the stored manifest and everything it references,
+// recursively, to the repository until expires, like link, if it's
+// restricted. The manifest is linked last, so if it's already linked until
+// then, so is everything it references.
+func (rt *Router) linkManifest(ctx context.Context, repo string, h v1.Hash, expires time.Time) error {
+	if !rt.restricted() || rt.linkedUntil(ctx, repo, h, expires) {
+		return nil
+	}
+	desc, err := rt.Storage.BlobExists(ctx, h.String())
+	if err != nil {
+		return fmt.Errorf("linking manifest %s: %w", h, err)
+	}
+	refs, err := manifestRefs(ctx, rt.Storage, h.String(), desc.MediaType)
+	if err != nil {
+		return fmt.Errorf("linking manifest %s: %w", h, err)
+	}
+	for _, ref := range refs {
+		if child, err := rt.Storage.BlobExists(ctx, ref.String()); err == nil && isManifest(child.MediaType) {
+			err = rt.linkManifest(ctx, repo, ref, expires)
+		} else {
+			err = rt.link(ctx, repo, ref, expires)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return rt.link(ctx, repo, h, expires)
+}
+
+// linkPushedTag links the manifest pushed to the tag, and everything it
+// references, to the repository until the tag expires, if it expires and the
+// repository is restricted. The tag is resolved the way pulls resolve it.
+func (rt *Router) linkPushedTag(ctx context.Context, repo, ref string, h v1.Hash) error {
+	if !rt.restricted() || strings.Contains(ref, ":") || rt.ResolveManifest == nil {
+		return nil
+	}
+	name, err := rt.ResolveManifest(ctx, repo, ref)
+	if err != nil {
+		return nil
+	}
+	o, err := rt.Storage.stat(ctx, name)
+	if err != nil || o.Expires.IsZero() || o.Digest != h {
+		return nil
+	}
+	return rt.linkManifest(ctx, repo, h, o.Expires)
+}
+
+// canMount reports whether the user can mount the blob from the repository
+// named by the from query parameter: it must be stored and, if access is
+// restricted, linked to that repository, which the user must be allowed to
+// pull.
+func (rt *Router) canMount(ctx context.Context, from string, h v1.Hash) bool {
+	if _, err := rt.Storage.BlobExists(ctx, h.String()); err != nil {
+		return false
+	}
+	if !rt.restricted() {
+		return true
+	}
+	a, _ := rt.auth()
+	return from != "" && slices.Contains(a.allowed(IdentityFromContext(ctx), from), "pull") && rt.linked(ctx, from, h)
+}
+
+// unlinkedRef returns the first blob, manifest or subject referenced by the
+// pushed manifest that isn't linked to the repository, if any, so that pushes
+// can't reference content the pusher can't pull.
+func (rt *Router) unlinkedRef(ctx context.Context, repo string, refs []v1.Hash, b []byte) (v1.Hash, bool) {
+	if !rt.restricted() {
+		return v1.Hash{}, false
+	}
+	for _, ref := range refs {
+		if !rt.linked(ctx, repo, ref) {
+			return ref, true
+		}
+	}
+	var m referrerManifest
+	if err := json.Unmarshal(b, &m); err == nil && m.Subject != nil && !rt.canRefer(ctx, repo, m.Subject.Digest) {
+		return m.Subject.Digest, true
+	}
+	return v1.Hash{}, false
+}
+
+// canRefer reports whether referrers of the subject can be pushed to the
+// repository. Referrers can be pushed before their subject, but not to a
+// subject that's only in other repositories.
+func (rt *Router) canRefer(ctx context.Context, repo string, subject v1.Hash) bool {
+	if rt.linked(ctx, repo, subject) {
+		return true
+	}
+	_, err := rt.Storage.BlobExists(ctx, subject.String())
+	return isNotExist(err)
+}
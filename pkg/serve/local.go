@@ -0,0 +1,413 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+type localStorage struct {
+	dir string
+
+	// mu serializes putObject, readObject and deleteIf, so generations
+	// are checked and updated atomically.
+	mu sync.Mutex
+}
+
+// NewLocalStorage returns a Storage backed by the given local directory.
+// Blobs are served directly by the service, so no cloud credentials are
+// needed to pull them.
+func NewLocalStorage(dir string) (Storage, error) {
+	for _, sub := range []string{"blobs", "meta", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("MkdirAll: %v", err)
+		}
+	}
+	return &localStorage{dir: dir}, nil
+}
+
+// localMeta is stored alongside each blob, and holds the metadata GCS would
+// otherwise store with the object.
+type localMeta struct {
+	ContentType string `json:"contentType"`
+	Digest      string `json:"digest,omitempty"`
+	// Expires is set by setExpiry, like a GCS object's custom time.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Generation is incremented by putObject, like a GCS object's
+	// generation. Objects written any other way are generation 1.
+	Generation int64 `json:"generation,omitempty"`
+}
+
+func (s *localStorage) path(sub, name string) (string, error) {
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid blob name %q", name)
+	}
+	return filepath.Join(s.dir, sub, name), nil
+}
+
+func (s *localStorage) statFiles(name string) (fs.FileInfo, *localMeta, error) {
+	bp, err := s.path("blobs", name)
+	if err != nil {
+		return nil, nil, err
+	}
+	mp, err := s.path("meta", name)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := os.Stat(bp)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := os.ReadFile(mp)
+	if err != nil {
+		return nil, nil, err
+	}
+	var m localMeta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, nil, err
+	}
+	return fi, &m, nil
+}
+
+func (s *localStorage) ServeBlob(w http.ResponseWriter, r *http.Request, name string) {
+	ctx := r.Context()
+	desc, err := s.BlobExists(ctx, name)
+	if err != nil {
+		slog.ErrorContext(ctx, "BlobExists", "name", name, "err", err)
+		Error(w, Errorf(BlobUnknown, "blob %q not found", name))
+		return
+	}
+	bp, _ := s.path("blobs", name)
+	f, err := os.Open(bp)
+	if err != nil {
+		slog.ErrorContext(ctx, "os.Open", "name", name, "err", err)
+		Error(w, Errorf(BlobUnknown, "blob %q not found", name))
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		slog.ErrorContext(ctx, "f.Stat", "name", name, "err", err)
+		Error(w, err)
+		return
+	}
+
+	// ServeContent handles HEAD, Range and If-None-Match requests for us.
+	setBlobHeaders(w, desc)
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+func (s *localStorage) BlobExists(ctx context.Context, name string) (v1.Descriptor, error) {
+	fi, m, err := s.statFiles(name)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	var h v1.Hash
+	if m.Digest != "" {
+		h, err = v1.NewHash(m.Digest)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+	}
+	return v1.Descriptor{
+		Digest:    h,
+		MediaType: types.MediaType(m.ContentType),
+		Size:      fi.Size(),
+	}, nil
+}
+
+func (s *localStorage) WriteObject(ctx context.Context, name, contents string) error {
+	return ignoreExists(s.createObject(ctx, name, contents))
+}
+
+func (s *localStorage) createObject(ctx context.Context, name, contents string) error {
+	return s.write(name, &localMeta{ContentType: "text/plain; charset=utf-8"}, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, contents)
+		return err
+	})
+}
+
+func (s *localStorage) putObject(ctx context.Context, name, contents string, generation int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, err := s.generation(name)
+	if err != nil {
+		return 0, err
+	}
+	if cur != generation {
+		return 0, errConflict
+	}
+	m := &localMeta{ContentType: "text/plain; charset=utf-8", Generation: cur + 1}
+	if err := s.writeFiles(name, m, cur != 0, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, contents)
+		return err
+	}); errors.Is(err, errExists) {
+		return 0, errConflict
+	} else if err != nil {
+		return 0, err
+	}
+	return m.Generation, nil
+}
+
+func (s *localStorage) readObject(ctx context.Context, name string) (string, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gen, err := s.generation(name)
+	if err != nil {
+		return "", 0, err
+	}
+	if gen == 0 {
+		return "", 0, fmt.Errorf("%q: %w", name, fs.ErrNotExist)
+	}
+	bp, _ := s.path("blobs", name)
+	b, err := os.ReadFile(bp)
+	if err != nil {
+		return "", 0, err
+	}
+	return strings.TrimSuffix(string(b), "\n"), gen, nil
+}
+
+func (s *localStorage) deleteIf(ctx context.Context, name string, generation int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, err := s.generation(name)
+	if err != nil {
+		return err
+	}
+	if cur == 0 || cur != generation {
+		return errConflict
+	}
+	return s.delete(ctx, name)
+}
+
+// generation returns the generation of the named object, or 0 if it doesn't
+// exist.
+func (s *localStorage) generation(name string) (int64, error) {
+	_, m, err := s.statFiles(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return max(m.Generation, 1), nil
+}
+
+func (s *localStorage) readBlob(ctx context.Context, name string) (io.ReadCloser, error) {
+	bp, err := s.path("blobs", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(bp)
+}
+
+func (s *localStorage) stat(ctx context.Context, name string) (objectInfo, error) {
+	fi, m, err := s.statFiles(name)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	desc, err := s.BlobExists(ctx, name)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	o := objectInfo{
+		Name:       name,
+		Created:    fi.ModTime(),
+		Descriptor: desc,
+	}
+	if m.Expires != nil {
+		o.Expires = *m.Expires
+	}
+	return o, nil
+}
+
+func (s *localStorage) list(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var out []objectInfo
+	root := filepath.Join(s.dir, "blobs")
+	if err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		o, err := s.stat(ctx, name)
+		if err != nil {
+			return err
+		}
+		out = append(out, o)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *localStorage) delete(ctx context.Context, name string) error {
+	bp, err := s.path("blobs", name)
+	if err != nil {
+		return err
+	}
+	mp, err := s.path("meta", name)
+	if err != nil {
+		return err
+	}
+	// Remove the blob first, so that it's never visible without its
+	// metadata.
+	if err := os.Remove(bp); err != nil {
+		return err
+	}
+	return os.Remove(mp)
+}
+
+// setExpiry rewrites the blob's metadata with the expiry, replacing it
+// atomically.
+func (s *localStorage) setExpiry(ctx context.Context, name string, t time.Time) error {
+	_, m, err := s.statFiles(name)
+	if err != nil {
+		return err
+	}
+	m.Expires = &t
+	mb, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	mp, _ := s.path("meta", name)
+	mf, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mf.Name())
+	if _, err := mf.Write(mb); err != nil {
+		mf.Close()
+		return err
+	}
+	if err := mf.Close(); err != nil {
+		return err
+	}
+	return os.Rename(mf.Name(), mp)
+}
+
+func (s *localStorage) writeBlob(ctx context.Context, name string, h v1.Hash, size int64, rc io.ReadCloser, contentType string) error {
+	start := time.Now()
+	defer func() { log.Printf("writeBlob(%q) took %s", name, time.Since(start)) }()
+	defer rc.Close()
+
+	v, err := newDigestVerifier(rc, h, size)
+	if err != nil {
+		return err
+	}
+	// If the contents don't match, the temp file is never linked into
+	// place.
+	m := &localMeta{ContentType: contentType}
+	if h != (v1.Hash{}) {
+		m.Digest = h.String()
+	}
+	if err := s.write(name, m, func(w io.Writer) error {
+		if _, err := io.Copy(w, v); err != nil {
+			return err
+		}
+		if err := v.verify(); err != nil {
+			return fmt.Errorf("writing %q: %w", name, err)
+		}
+		return nil
+	}); err != nil {
+		return ignoreExists(err)
+	}
+	blobBytesWritten.Observe(float64(v.n))
+	return nil
+}
+
+// write writes the blob and its metadata to temp files, then links them into
+// place. Like GCS's DoesNotExist precondition, if the blob already exists
+// it's left as-is and errExists is returned.
+func (s *localStorage) write(name string, m *localMeta, fn func(io.Writer) error) error {
+	return s.writeFiles(name, m, false, fn)
+}
+
+// writeFiles is like write, but if replace is true, it atomically replaces
+// the blob and its metadata if they already exist.
+func (s *localStorage) writeFiles(name string, m *localMeta, replace bool, fn func(io.Writer) error) error {
+	bp, err := s.path("blobs", name)
+	if err != nil {
+		return err
+	}
+	mp, err := s.path("meta", name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(bp); err == nil && !replace {
+		return errExists
+	}
+
+	bf, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(bf.Name())
+	if err := fn(bf); err != nil {
+		bf.Close()
+		return fmt.Errorf("Copy: %w", err)
+	}
+	if err := bf.Close(); err != nil {
+		return err
+	}
+
+	mb, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	mf, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mf.Name())
+	if _, err := mf.Write(mb); err != nil {
+		mf.Close()
+		return err
+	}
+	if err := mf.Close(); err != nil {
+		return err
+	}
+
+	// Link the metadata first, so that a blob is never visible without
+	// its metadata.
+	for _, p := range []string{mp, bp} {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+	}
+	if replace {
+		if err := os.Rename(mf.Name(), mp); err != nil {
+			return err
+		}
+		return os.Rename(bf.Name(), bp)
+	}
+	if err := os.Link(mf.Name(), mp); err != nil && !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("Link: %v", err)
+	}
+	if err := os.Link(bf.Name(), bp); errors.Is(err, fs.ErrExist) {
+		return errExists
+	} else if err != nil {
+		return fmt.Errorf("Link: %v", err)
+	}
+	return nil
+}
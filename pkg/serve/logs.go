@@ -0,0 +1,226 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBuildLogSize is the maximum size of a stored build log. Output past
+// this is dropped.
+const maxBuildLogSize = 1 << 20
+
+// buildLog collects log output for a single build.
+type buildLog struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (l *buildLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rem := maxBuildLogSize - l.buf.Len(); len(p) > rem {
+		l.buf.Write(p[:max(rem, 0)])
+		l.truncated = true
+	} else {
+		l.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (l *buildLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.truncated {
+		return l.buf.String() + "\n[log truncated]"
+	}
+	return l.buf.String()
+}
+
+type buildLogKey struct{}
+
+func logsName(ck string) string { return fmt.Sprintf("logs-%s", ck) }
+
+// captureLogs returns a context whose slog records are also written to the
+// returned build log. That includes apko's logs, since clog logs with the
+// context it's given. Output that isn't logged with the build's context, like
+// the log package's, can't be attributed to the build and isn't captured.
+func captureLogs(ctx context.Context) (context.Context, *buildLog) {
+	installLogHandler()
+	l := &buildLog{}
+	return context.WithValue(ctx, buildLogKey{}, l), l
+}
+
+// logsRecord is a stored build log, along with the repository the build was
+// started for, which users must be able to pull to read it.
+type logsRecord struct {
+	repoRef
+	Log string `json:"log"`
+}
+
+// saveLogs stores the build log for the cache key, replacing any log from a
+// previous build, and returns the URL where it's served.
+func saveLogs(ctx context.Context, st Storage, ck string, l *buildLog, err error) string {
+	if err != nil {
+		fmt.Fprintf(l, "\nbuild failed: %v\n", err)
+	} else {
+		fmt.Fprintf(l, "\nbuild succeeded\n")
+	}
+	name := logsName(ck)
+	if _, err := st.BlobExists(ctx, name); err == nil {
+		if err := st.delete(ctx, name); err != nil {
+			slog.WarnContext(ctx, "deleting previous build log", "name", name, "err", err)
+		}
+	}
+	b, err := json.Marshal(logsRecord{repoRef: repoFromContext(ctx), Log: l.String()})
+	if err == nil {
+		err = st.WriteObject(ctx, name, string(b))
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "storing build log", "name", name, "err", err)
+	}
+	return logsURL(ctx, ck)
+}
+
+// readLogs returns the stored build log for the cache key.
+func readLogs(ctx context.Context, st Storage, ck string) (logsRecord, error) {
+	contents, _, err := st.readObject(ctx, logsName(ck))
+	if err != nil {
+		return logsRecord{}, err
+	}
+	var rec logsRecord
+	if err := json.Unmarshal([]byte(contents), &rec); err != nil {
+		return logsRecord{}, fmt.Errorf("parsing build log for %q: %w", ck, err)
+	}
+	return rec, nil
+}
+
+// logsURL returns the URL where the build log for the cache key is served,
+// relative to the host of the request being served, if any.
+func logsURL(ctx context.Context, ck string) string {
+	path := "/logs/" + ck
+	r := RequestFromContext(ctx)
+	if r == nil {
+		return path
+	}
+	return externalURL(r, path)
+}
+
+// externalURL returns the URL of the path on the host serving the request, as
+// the client sees it.
+func externalURL(r *http.Request, path string) string {
+	if r.Host == "" {
+		return path
+	}
+	scheme := "https"
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		scheme = p
+	} else if r.TLS == nil {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, path)
+}
+
+// serveLogs serves the build log for the cache key named in the request path,
+// if the user can pull the repository the build was started for.
+func (rt *Router) serveLogs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ck := strings.TrimPrefix(r.URL.Path, "/logs/")
+	if ck == "" || strings.Contains(ck, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	rec, err := readLogs(ctx, rt.Storage, ck)
+	if isNotExist(err) {
+		http.Error(w, fmt.Sprintf("no build log found for %q", ck), http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "reading build log", "ck", ck, "err", err)
+		http.Error(w, "reading build log", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := rt.authorizeRepo(w, r, rec.repoRef); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, rec.Log)
+}
+
+// installLogHandler makes the default slog handler also write records logged
+// with a build's context to that build's log, and annotate records with the
+// user's identity. The log package's output goes through the same handler.
+var installLogHandler = sync.OnceFunc(func() {
+	next := slog.Default().Handler()
+	// slog's built-in default handler writes through the log package,
+	// which slog.SetDefault redirects to the new handler. Replace it with
+	// a text handler writing where the log package was, to avoid a loop.
+	if fmt.Sprintf("%T", next) == "*slog.defaultHandler" {
+		next = slog.NewTextHandler(log.Writer(), nil)
+	}
+	slog.SetDefault(slog.New(&logHandler{next: next}))
+})
+
+// logHandler passes records to next, and writes those logged with a build's
+// context to the build's log as text. Records logged with the context of an
+// authenticated request are annotated with the user's identity.
+type logHandler struct {
+	next slog.Handler
+	// ops are the WithAttrs and WithGroup calls made on the handler, to be
+	// applied to the build log's handler.
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	if user := IdentityFromContext(ctx); user != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String("user", user))
+	}
+	if l, ok := ctx.Value(buildLogKey{}).(*buildLog); ok {
+		h.buildHandler(l).Handle(ctx, r)
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// buildHandler returns a handler that writes records to w as text, as they're
+// written to build logs.
+func (h *logHandler) buildHandler(w io.Writer) slog.Handler {
+	var bh slog.Handler = slog.NewTextHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.String(slog.TimeKey, a.Value.Time().UTC().Format(time.RFC3339))
+			}
+			return a
+		},
+	})
+	for _, op := range h.ops {
+		bh = op(bh)
+	}
+	return bh
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{
+		next: h.next.WithAttrs(attrs),
+		ops:  append(h.ops[:len(h.ops):len(h.ops)], func(bh slog.Handler) slog.Handler { return bh.WithAttrs(attrs) }),
+	}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{
+		next: h.next.WithGroup(name),
+		ops:  append(h.ops[:len(h.ops):len(h.ops)], func(bh slog.Handler) slog.Handler { return bh.WithGroup(name) }),
+	}
+}
@@ -0,0 +1,49 @@
+package serve
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/clog"
+)
+
+func TestBuildLogs(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+	other := context.WithValue(ctx, requestKey{}, &http.Request{Host: "example.com"})
+
+	bctx, l := captureLogs(ctx)
+	slog.InfoContext(bctx, "from the build")
+	clog.FromContext(bctx).Infof("from clog")
+	slog.InfoContext(other, "from another request")
+	slog.InfoContext(ctx, "from the background")
+	log.Printf("from the log package")
+	saveLogs(ctx, st, "ck", l, nil)
+
+	rec, err := readLogs(ctx, st, "ck")
+	if err != nil {
+		t.Fatalf("readLogs: %v", err)
+	}
+	got := rec.Log
+	for _, c := range []struct {
+		line string
+		want bool
+	}{
+		{"from the build", true},
+		{"from clog", true},
+		{"build succeeded", true},
+		// Output that isn't logged with the build's context could be
+		// from anything else running, like other users' builds.
+		{"from another request", false},
+		{"from the background", false},
+		{"from the log package", false},
+	} {
+		if strings.Contains(got, c.line) != c.want {
+			t.Errorf("build log contains %q: got %t, want %t\n%s", c.line, !c.want, c.want, got)
+		}
+	}
+}
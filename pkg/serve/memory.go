@@ -0,0 +1,210 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+type memoryStorage struct {
+	mu      sync.Mutex
+	objects map[string]*memoryObject
+	// gen is the generation of the last object written.
+	gen int64
+}
+
+type memoryObject struct {
+	contents   []byte
+	info       objectInfo
+	generation int64
+}
+
+// NewMemoryStorage returns a Storage that holds blobs in memory, and serves
+// them directly. It's meant for tests, and for trying services out without
+// writing anything to disk.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{objects: map[string]*memoryObject{}}
+}
+
+func (s *memoryStorage) get(name string) (*memoryObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", name, fs.ErrNotExist)
+	}
+	return o, nil
+}
+
+func (s *memoryStorage) ServeBlob(w http.ResponseWriter, r *http.Request, name string) {
+	ctx := r.Context()
+	o, err := s.get(name)
+	if err != nil {
+		slog.ErrorContext(ctx, "BlobExists", "name", name, "err", err)
+		Error(w, Errorf(BlobUnknown, "blob %q not found", name))
+		return
+	}
+
+	// ServeContent handles HEAD, Range and If-None-Match requests for us.
+	setBlobHeaders(w, o.info.Descriptor)
+	http.ServeContent(w, r, "", o.info.Created, bytes.NewReader(o.contents))
+}
+
+func (s *memoryStorage) BlobExists(ctx context.Context, name string) (v1.Descriptor, error) {
+	o, err := s.stat(ctx, name)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return o.Descriptor, nil
+}
+
+func (s *memoryStorage) WriteObject(ctx context.Context, name, contents string) error {
+	return ignoreExists(s.createObject(ctx, name, contents))
+}
+
+func (s *memoryStorage) createObject(ctx context.Context, name, contents string) error {
+	return s.write(name, []byte(contents+"\n"), v1.Hash{}, "text/plain; charset=utf-8")
+}
+
+func (s *memoryStorage) putObject(ctx context.Context, name, contents string, generation int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[name]
+	if (generation == 0 && ok) || (generation != 0 && (!ok || o.generation != generation)) {
+		return 0, errConflict
+	}
+	s.putLocked(name, []byte(contents+"\n"), v1.Hash{}, "text/plain; charset=utf-8")
+	return s.gen, nil
+}
+
+func (s *memoryStorage) readObject(ctx context.Context, name string) (string, int64, error) {
+	o, err := s.get(name)
+	if err != nil {
+		return "", 0, err
+	}
+	return strings.TrimSuffix(string(o.contents), "\n"), o.generation, nil
+}
+
+func (s *memoryStorage) deleteIf(ctx context.Context, name string, generation int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o, ok := s.objects[name]; !ok || o.generation != generation {
+		return errConflict
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memoryStorage) readBlob(ctx context.Context, name string) (io.ReadCloser, error) {
+	o, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(o.contents)), nil
+}
+
+func (s *memoryStorage) stat(ctx context.Context, name string) (objectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[name]
+	if !ok {
+		return objectInfo{}, fmt.Errorf("%q: %w", name, fs.ErrNotExist)
+	}
+	return o.info, nil
+}
+
+func (s *memoryStorage) list(ctx context.Context, prefix string) ([]objectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []objectInfo
+	for name, o := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			out = append(out, o.info)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (s *memoryStorage) delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[name]; !ok {
+		return fmt.Errorf("%q: %w", name, fs.ErrNotExist)
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memoryStorage) setExpiry(ctx context.Context, name string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[name]
+	if !ok {
+		return fmt.Errorf("%q: %w", name, fs.ErrNotExist)
+	}
+	o.info.Expires = t
+	return nil
+}
+
+func (s *memoryStorage) writeBlob(ctx context.Context, name string, h v1.Hash, size int64, rc io.ReadCloser, contentType string) error {
+	defer rc.Close()
+
+	v, err := newDigestVerifier(rc, h, size)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(v)
+	if err != nil {
+		return err
+	}
+	if err := v.verify(); err != nil {
+		return fmt.Errorf("writing %q: %w", name, err)
+	}
+	if err := s.write(name, b, h, contentType); err != nil {
+		return ignoreExists(err)
+	}
+	blobBytesWritten.Observe(float64(v.n))
+	return nil
+}
+
+// write stores the blob. Like GCS's DoesNotExist precondition, if the blob
+// already exists it's left as-is and errExists is returned.
+func (s *memoryStorage) write(name string, b []byte, h v1.Hash, contentType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[name]; ok {
+		return errExists
+	}
+	s.putLocked(name, b, h, contentType)
+	return nil
+}
+
+// putLocked stores the blob as a new generation. s.mu must be held.
+func (s *memoryStorage) putLocked(name string, b []byte, h v1.Hash, contentType string) {
+	s.gen++
+	s.objects[name] = &memoryObject{
+		contents:   b,
+		generation: s.gen,
+		info: objectInfo{
+			Name:    name,
+			Created: time.Now(),
+			Descriptor: v1.Descriptor{
+				Digest:    h,
+				MediaType: types.MediaType(contentType),
+				Size:      int64(len(b)),
+			},
+		},
+	}
+}
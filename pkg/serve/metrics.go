@@ -0,0 +1,101 @@
+package serve
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are served by httpmetrics.ServeMetrics, started in init.
+var (
+	cacheLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kontain_cache_lookups_total",
+			Help: "The number of cache key lookups, by service and whether they hit.",
+		},
+		[]string{"service", "result"},
+	)
+	phaseDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kontain_build_phase_duration_seconds",
+			Help:    "A histogram of time spent in each phase of building an image, by service.",
+			Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 900},
+		},
+		[]string{"service", "phase", "result"},
+	)
+	blobBytesWritten = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "kontain_blob_write_bytes",
+			Help:    "A histogram of the sizes of blobs written to storage.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12), // 1KiB to 4GiB
+		},
+	)
+
+	buildResults = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kontain_build_requests_total",
+			Help: "The number of requests to build a cache key, by how they were satisfied.",
+		},
+		[]string{"result"},
+	)
+	rateLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kontain_rate_limited_total",
+			Help: "The number of requests rejected for exceeding a client's rate limit, by budget.",
+		},
+		[]string{"budget"},
+	)
+	leaseTakeovers = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kontain_build_lease_takeovers_total",
+			Help: "The number of expired build leases taken over from another instance.",
+		},
+	)
+
+	layersSkipped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kontain_layers_skipped_total",
+			Help: "The number of layers not written because they were already stored.",
+		},
+	)
+	layerBytesSkipped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kontain_layer_bytes_skipped_total",
+			Help: "The number of compressed layer bytes not written because they were already stored.",
+		},
+	)
+	layerSecondsSaved = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kontain_layer_write_seconds_saved_total",
+			Help: "The estimated time saved by not writing layers that were already stored, based on observed write throughput.",
+		},
+	)
+)
+
+// RecordCacheLookup records whether looking up a service's cache key found a
+// cached manifest.
+func RecordCacheLookup(service string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(service, result).Inc()
+}
+
+// TimePhase starts timing a phase of a service's build. Calling the returned
+// function with the phase's result records the time spent:
+//
+//	done := serve.TimePhase("ko", "build")
+//	br, err := g.Build(ctx, ip)
+//	done(err)
+func TimePhase(service, phase string) func(error) {
+	start := time.Now()
+	return func(err error) {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		phaseDuration.WithLabelValues(service, phase, result).Observe(time.Since(start).Seconds())
+	}
+}
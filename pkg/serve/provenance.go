@@ -0,0 +1,171 @@
+package serve
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	inTotoStatementType     = "https://in-toto.io/Statement/v1"
+	inTotoPayloadType       = "application/vnd.in-toto+json"
+	slsaProvenanceType      = "https://slsa.dev/provenance/v1"
+	dsseEnvelopeMediaType   = "application/vnd.dsse.envelope.v1+json"
+	predicateTypeAnnotation = "predicateType"
+)
+
+// Provenance describes how an image was built. It's recorded as a SLSA v1
+// provenance predicate.
+type Provenance struct {
+	// BuilderID identifies the service that built the image.
+	BuilderID string
+	// BuildType identifies how ExternalParameters and InternalParameters
+	// are interpreted.
+	BuildType string
+	// ExternalParameters are the inputs to the build requested by the
+	// client.
+	ExternalParameters any
+	// InternalParameters are inputs to the build set by the service.
+	InternalParameters any
+	// ResolvedDependencies are the artifacts fetched during the build,
+	// like source code and base images.
+	ResolvedDependencies []ResourceDescriptor
+	// InvocationID identifies the build, like its cache key.
+	InvocationID string
+	// Started and Finished are when the build started and finished.
+	Started, Finished time.Time
+}
+
+// ResourceDescriptor describes an artifact used by a build.
+type ResourceDescriptor struct {
+	URI         string            `json:"uri,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// slsaProvenance is the SLSA v1 provenance predicate.
+type slsaProvenance struct {
+	BuildDefinition struct {
+		BuildType            string               `json:"buildType"`
+		ExternalParameters   any                  `json:"externalParameters"`
+		InternalParameters   any                  `json:"internalParameters,omitempty"`
+		ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies,omitempty"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version,omitempty"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string    `json:"invocationId,omitempty"`
+			StartedOn    time.Time `json:"startedOn"`
+			FinishedOn   time.Time `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+type inTotoStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     any                  `json:"predicate"`
+}
+
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// AttestProvenance writes a signed in-toto statement with the image's SLSA
+// provenance, as a cosign-compatible attestation served by the
+// sha256-<hex>.att tag and listed among the image's referrers. The statement
+// names the image as repo on the host serving the request, if any. If signer
+// is nil, nothing is written, since an unsigned attestation can't be
+// verified.
+//
+// Like SignImage, it should be called before the image is written.
+func AttestProvenance(ctx context.Context, st Storage, signer crypto.Signer, repo string, d partial.Describable, p Provenance) error {
+	if signer == nil {
+		return nil
+	}
+	desc, err := partial.Descriptor(d)
+	if err != nil {
+		return err
+	}
+	repo = externalRepo(ctx, repo)
+
+	var pred slsaProvenance
+	pred.BuildDefinition.BuildType = p.BuildType
+	pred.BuildDefinition.ExternalParameters = p.ExternalParameters
+	pred.BuildDefinition.InternalParameters = p.InternalParameters
+	pred.BuildDefinition.ResolvedDependencies = p.ResolvedDependencies
+	pred.RunDetails.Builder.ID = p.BuilderID
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				pred.RunDetails.Builder.Version = map[string]string{"kontain.me": s.Value}
+			}
+		}
+	}
+	pred.RunDetails.Metadata.InvocationID = p.InvocationID
+	pred.RunDetails.Metadata.StartedOn = p.Started.UTC()
+	pred.RunDetails.Metadata.FinishedOn = p.Finished.UTC()
+
+	statement, err := json.Marshal(inTotoStatement{
+		Type: inTotoStatementType,
+		Subject: []ResourceDescriptor{{
+			Name:   repo,
+			Digest: map[string]string{desc.Digest.Algorithm: desc.Digest.Hex},
+		}},
+		PredicateType: slsaProvenanceType,
+		Predicate:     pred,
+	})
+	if err != nil {
+		return err
+	}
+
+	// DSSE signs the pre-authentication encoding of the payload, not the
+	// payload itself.
+	pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(inTotoPayloadType), inTotoPayloadType, len(statement), statement)
+	sig, err := signPayload(signer, []byte(pae))
+	if err != nil {
+		return fmt.Errorf("signing provenance for %s: %w", desc.Digest, err)
+	}
+	envelope, err := json.Marshal(dsseEnvelope{
+		PayloadType: inTotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(statement),
+		Signatures:  []dsseSignature{{Sig: base64.StdEncoding.EncodeToString(sig)}},
+	})
+	if err != nil {
+		return err
+	}
+
+	img, err := mutate.Append(mutate.MediaType(empty.Image, types.OCIManifestSchema1), mutate.Addendum{
+		Layer: static.NewLayer(envelope, dsseEnvelopeMediaType),
+		Annotations: map[string]string{
+			predicateTypeAnnotation: slsaProvenanceType,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	img = mutate.ConfigMediaType(img, dsseEnvelopeMediaType)
+	return Attach(ctx, st, "att", d, img)
+}
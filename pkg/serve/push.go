@@ -0,0 +1,470 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// maxManifestSize is the largest manifest that can be pushed.
+const maxManifestSize = 4 << 20
+
+// Uploaded blobs are stored without a media type; it's up to the manifests
+// that reference them to say what they are.
+const uploadContentType = "application/octet-stream"
+
+var uploadIDRE = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// An upload in progress is stored as an "upload-<id>" object containing the
+// repository it was started in, and a chunk object for each PATCH, named by
+// the chunk's offset so that listing them returns them in order.
+func uploadName(id string) string  { return fmt.Sprintf("upload-%s", id) }
+func chunkPrefix(id string) string { return fmt.Sprintf("upload-%s-", id) }
+func chunkName(id string, offset int64) string {
+	return fmt.Sprintf("%s%020d", chunkPrefix(id), offset)
+}
+
+// uploadPath parses the path of a blob upload request, which is either
+// <name>/blobs/uploads/ or <name>/blobs/uploads/<id>.
+func uploadPath(parts []string) (repo, id string, ok bool) {
+	n := len(parts)
+	switch {
+	case n >= 3 && parts[n-2] == "blobs" && parts[n-1] == "uploads":
+		return strings.Join(parts[:n-2], "/"), "", true
+	case n >= 4 && parts[n-3] == "blobs" && parts[n-2] == "uploads":
+		return strings.Join(parts[:n-3], "/"), parts[n-1], true
+	}
+	return "", "", false
+}
+
+// serveUpload serves requests to start, continue, finish, check or cancel a
+// blob upload.
+func (rt *Router) serveUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	ctx := r.Context()
+	if id == "" {
+		if r.Method != http.MethodPost {
+			Error(w, Errorf(Unsupported, "method %s not allowed", r.Method))
+			return
+		}
+		rt.startUpload(w, r, repo)
+		return
+	}
+
+	if !uploadIDRE.MatchString(id) {
+		Error(w, Errorf(BlobUploadUnknown, "upload %q not found", id))
+		return
+	}
+	if _, err := rt.Storage.BlobExists(ctx, uploadName(id)); err != nil {
+		slog.InfoContext(ctx, "BlobExists", "upload", id, "err", err)
+		Error(w, Errorf(BlobUploadUnknown, "upload %q not found", id))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		size, err := rt.uploadSize(ctx, id)
+		if err != nil {
+			Error(w, err)
+			return
+		}
+		uploadStatus(w, r, repo, id, size, http.StatusNoContent)
+	case http.MethodPatch:
+		rt.patchUpload(w, r, repo, id)
+	case http.MethodPut:
+		rt.finishUpload(w, r, repo, id)
+	case http.MethodDelete:
+		if err := rt.deleteUpload(ctx, id); err != nil {
+			Error(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		Error(w, Errorf(Unsupported, "method %s not allowed", r.Method))
+	}
+}
+
+// startUpload mounts a blob, uploads a blob in a single POST, or starts an
+// upload to be continued with PATCH and PUT requests.
+func (rt *Router) startUpload(w http.ResponseWriter, r *http.Request, repo string) {
+	ctx := r.Context()
+	q := r.URL.Query()
+
+	// Blobs are stored by digest regardless of repository, so any stored
+	// blob the user can pull from the repository it's mounted from can be
+	// mounted. If it can't, the spec says to start a regular upload
+	// instead.
+	if mount := q.Get("mount"); mount != "" {
+		if h, err := v1.NewHash(mount); err == nil && rt.canMount(ctx, q.Get("from"), h) {
+			if err := rt.link(ctx, repo, h, time.Time{}); err != nil {
+				Error(w, err)
+				return
+			}
+			blobCreated(w, r, repo, h)
+			return
+		}
+	}
+
+	if d := q.Get("digest"); d != "" {
+		h, err := v1.NewHash(d)
+		if err != nil {
+			Error(w, Errorf(DigestInvalid, "invalid digest %q: %w", d, err))
+			return
+		}
+		if err := rt.Storage.writeBlob(ctx, h.String(), h, r.ContentLength, r.Body, uploadContentType); err != nil {
+			Error(w, uploadError(err))
+			return
+		}
+		if err := rt.link(ctx, repo, h, time.Time{}); err != nil {
+			Error(w, err)
+			return
+		}
+		blobCreated(w, r, repo, h)
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		Error(w, err)
+		return
+	}
+	id := hex.EncodeToString(b)
+	if err := rt.Storage.WriteObject(ctx, uploadName(id), repo); err != nil {
+		Error(w, err)
+		return
+	}
+	uploadStatus(w, r, repo, id, 0, http.StatusAccepted)
+}
+
+// patchUpload appends the request body to the upload.
+func (rt *Router) patchUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	ctx := r.Context()
+	offset, err := rt.uploadSize(ctx, id)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		var start, end int64
+		if _, err := fmt.Sscanf(cr, "%d-%d", &start, &end); err != nil || start != offset {
+			w.Header().Set("Range", rangeHeader(offset))
+			Error(w, &RegistryError{
+				Code:    BlobUploadInvalid,
+				Status:  http.StatusRequestedRangeNotSatisfiable,
+				Message: fmt.Sprintf("Content-Range %q doesn't start at offset %d", cr, offset),
+			})
+			return
+		}
+	}
+	n, err := rt.writeChunk(ctx, id, offset, r)
+	if err != nil {
+		Error(w, uploadError(err))
+		return
+	}
+	uploadStatus(w, r, repo, id, offset+n, http.StatusAccepted)
+}
+
+// finishUpload appends the request body, if any, to the upload, then writes
+// the uploaded contents to a blob named by the digest in the query, if they
+// match it.
+func (rt *Router) finishUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	ctx := r.Context()
+	d := r.URL.Query().Get("digest")
+	h, err := v1.NewHash(d)
+	if err != nil {
+		Error(w, Errorf(DigestInvalid, "invalid digest %q: %w", d, err))
+		return
+	}
+	offset, err := rt.uploadSize(ctx, id)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if _, err := rt.writeChunk(ctx, id, offset, r); err != nil {
+		Error(w, uploadError(err))
+		return
+	}
+
+	chunks, err := rt.Storage.list(ctx, chunkPrefix(id))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Name < chunks[j].Name })
+	var size int64
+	for _, c := range chunks {
+		size += c.Size
+	}
+
+	// Stream the chunks, in order, to the blob. writeBlob doesn't always
+	// read everything or close the reader, so close it when it returns to
+	// stop the copying goroutine.
+	pr, pw := io.Pipe()
+	go func() {
+		for _, c := range chunks {
+			rc, err := rt.Storage.readBlob(ctx, c.Name)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(pw, rc)
+			rc.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	err = rt.Storage.writeBlob(ctx, h.String(), h, size, pr, uploadContentType)
+	pr.Close()
+	if err != nil {
+		Error(w, uploadError(err))
+		return
+	}
+	if err := rt.deleteUpload(ctx, id); err != nil {
+		slog.WarnContext(ctx, "deleting finished upload", "upload", id, "err", err)
+	}
+	if err := rt.link(ctx, repo, h, time.Time{}); err != nil {
+		Error(w, err)
+		return
+	}
+	blobCreated(w, r, repo, h)
+}
+
+// writeChunk writes the request body, if any, as the upload's chunk at the
+// offset, and returns its size.
+func (rt *Router) writeChunk(ctx context.Context, id string, offset int64, r *http.Request) (int64, error) {
+	if r.ContentLength == 0 {
+		return 0, nil
+	}
+	name := chunkName(id, offset)
+	if err := rt.Storage.writeBlob(ctx, name, v1.Hash{}, r.ContentLength, r.Body, uploadContentType); err != nil {
+		return 0, err
+	}
+	desc, err := rt.Storage.BlobExists(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	if desc.Size == 0 {
+		// Don't leave an empty chunk where the next one needs to go.
+		return 0, rt.Storage.delete(ctx, name)
+	}
+	return desc.Size, nil
+}
+
+// uploadSize returns the number of bytes uploaded so far.
+func (rt *Router) uploadSize(ctx context.Context, id string) (int64, error) {
+	chunks, err := rt.Storage.list(ctx, chunkPrefix(id))
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, c := range chunks {
+		size += c.Size
+	}
+	return size, nil
+}
+
+// deleteUpload deletes the upload's chunks, then the upload itself.
+func (rt *Router) deleteUpload(ctx context.Context, id string) error {
+	chunks, err := rt.Storage.list(ctx, chunkPrefix(id))
+	if err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if err := rt.Storage.delete(ctx, c.Name); err != nil {
+			return err
+		}
+	}
+	return rt.Storage.delete(ctx, uploadName(id))
+}
+
+// uploadError returns the registry error to serve when writing uploaded
+// contents fails.
+func uploadError(err error) error {
+	if errors.Is(err, ErrDigestMismatch) {
+		return Errorf(DigestInvalid, "%w", err)
+	}
+	return err
+}
+
+// clientPath returns the path under /v2/ as the client would request it,
+// including any prefix that was stripped from the request's path before it was
+// routed, like the service name in kontain's /v2/<service>/ paths.
+func clientPath(r *http.Request, path string) string {
+	prefix := clientPrefix(r)
+	if prefix == "" {
+		return path
+	}
+	return "/v2/" + prefix + strings.TrimPrefix(path, "/v2/")
+}
+
+// clientPrefix returns the prefix that was stripped from the request's path
+// under /v2/ before it was routed, like "ko/" in kontain, or "" if none was.
+func clientPrefix(r *http.Request) string {
+	requested, _, _ := strings.Cut(r.RequestURI, "?")
+	routed := strings.TrimPrefix(r.URL.Path, "/v2/")
+	prefix, ok := strings.CutSuffix(strings.TrimPrefix(requested, "/v2/"), routed)
+	if !ok || requested == "" {
+		return ""
+	}
+	return prefix
+}
+
+// externalRepo returns the name clients pull repo by from the registry
+// serving the request in ctx, like "kontain.me/ko/github.com/google/ko",
+// including its host and any prefix stripped before routing. Outside of a
+// request, it returns repo.
+func externalRepo(ctx context.Context, repo string) string {
+	r := RequestFromContext(ctx)
+	if r == nil || r.Host == "" {
+		return repo
+	}
+	return r.Host + "/" + clientPrefix(r) + repo
+}
+
+func rangeHeader(size int64) string {
+	return fmt.Sprintf("0-%d", max(size-1, 0))
+}
+
+func uploadStatus(w http.ResponseWriter, r *http.Request, repo, id string, size int64, status int) {
+	w.Header().Set("Location", clientPath(r, fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id)))
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.Header().Set("Range", rangeHeader(size))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+}
+
+func blobCreated(w http.ResponseWriter, r *http.Request, repo string, h v1.Hash) {
+	w.Header().Set("Location", clientPath(r, fmt.Sprintf("/v2/%s/blobs/%s", repo, h)))
+	w.Header().Set("Docker-Content-Digest", h.String())
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// putManifest stores a pushed manifest by digest, once all the blobs and
+// manifests it references are stored, then passes it to PushManifest.
+func (rt *Router) putManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	ctx := r.Context()
+	if strings.Contains(ref, ":") {
+		if _, err := v1.NewHash(ref); err != nil {
+			Error(w, Errorf(DigestInvalid, "invalid digest %q: %w", ref, err))
+			return
+		}
+	} else if !tagRE.MatchString(ref) {
+		Error(w, Errorf(TagInvalid, "invalid tag %q", ref))
+		return
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if len(b) > maxManifestSize {
+		Error(w, Errorf(SizeInvalid, "manifest is larger than %d bytes", maxManifestSize))
+		return
+	}
+	mt := types.MediaType(r.Header.Get("Content-Type"))
+	if !isManifest(mt) {
+		// Fall back to the manifest's own mediaType field.
+		var m struct {
+			MediaType types.MediaType `json:"mediaType"`
+		}
+		if err := json.Unmarshal(b, &m); err != nil || !isManifest(m.MediaType) {
+			Error(w, Errorf(ManifestInvalid, "unsupported manifest media type %q", mt))
+			return
+		}
+		mt = m.MediaType
+	}
+	h, size, err := v1.SHA256(bytes.NewReader(b))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if strings.Contains(ref, ":") && ref != h.String() {
+		Error(w, Errorf(DigestInvalid, "manifest has digest %s, not %s", h, ref))
+		return
+	}
+
+	refs, err := parseRefs(b, mt)
+	if err != nil {
+		Error(w, Errorf(ManifestInvalid, "parsing manifest: %w", err))
+		return
+	}
+	for d := range missingBlobs(ctx, rt.Storage, refs) {
+		Error(w, Errorf(ManifestBlobUnknown, "manifest references unknown blob %s", d))
+		return
+	}
+	if d, ok := rt.unlinkedRef(ctx, repo, refs, b); ok {
+		Error(w, Errorf(ManifestBlobUnknown, "manifest references %s, which isn't in %s", d, repo))
+		return
+	}
+	if fs, ok := fallbackSubject(ref); ok && !rt.canRefer(ctx, repo, fs) {
+		Error(w, Errorf(ManifestUnknown, "manifest %s not found in %s", fs, repo))
+		return
+	}
+
+	if err := rt.Storage.writeBlob(ctx, h.String(), h, size, io.NopCloser(bytes.NewReader(b)), string(mt)); err != nil {
+		Error(w, err)
+		return
+	}
+	desc := v1.Descriptor{MediaType: mt, Digest: h, Size: size}
+	subject, err := indexReferrer(ctx, rt.Storage, desc, b)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if err := rt.link(ctx, repo, h, time.Time{}); err != nil {
+		Error(w, err)
+		return
+	}
+	if fs, ok := fallbackSubject(ref); ok && mt.IsIndex() {
+		// Clients that don't support the referrers API push an index
+		// of referrers to this tag. Since the tag itself is served from
+		// the referrers index, add them there.
+		var im v1.IndexManifest
+		if err := json.Unmarshal(b, &im); err != nil {
+			Error(w, Errorf(ManifestInvalid, "parsing index: %w", err))
+			return
+		}
+		for _, d := range im.Manifests {
+			if err := addReferrer(ctx, rt.Storage, fs, d); err != nil {
+				Error(w, err)
+				return
+			}
+		}
+	}
+	if err := rt.PushManifest(ctx, repo, ref, desc); err != nil {
+		slog.ErrorContext(ctx, "PushManifest", "repo", repo, "ref", ref, "err", err)
+		Error(w, err)
+		return
+	}
+	if err := rt.linkPushedTag(ctx, repo, ref, h); err != nil {
+		slog.ErrorContext(ctx, "linkPushedTag", "repo", repo, "ref", ref, "err", err)
+		Error(w, err)
+		return
+	}
+	if subject != (v1.Hash{}) {
+		// Tells clients the referrers API lists the manifest, so they
+		// don't need to update the referrers tag schema's index.
+		w.Header().Set("OCI-Subject", subject.String())
+	}
+	w.Header().Set("Location", clientPath(r, fmt.Sprintf("/v2/%s/manifests/%s", repo, h)))
+	w.Header().Set("Docker-Content-Digest", h.String())
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,293 @@
+package serve
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter counts requests against per-client budgets, in fixed windows.
+type RateLimiter interface {
+	// Take records a request by the client against the named budget,
+	// which allows at most limit requests per window. If the request is
+	// allowed it returns zero, and otherwise how long until the next window
+	// starts.
+	Take(ctx context.Context, budget, client string, limit Limit) (time.Duration, error)
+}
+
+// Limit is a number of requests allowed per period.
+type Limit struct {
+	N   int
+	Per time.Duration
+}
+
+// ParseLimit parses a limit like 600/1m.
+func ParseLimit(s string) (Limit, error) {
+	n, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid limit %q: want requests/period, like 10/1h", s)
+	}
+	l := Limit{}
+	var err error
+	if l.N, err = strconv.Atoi(n); err != nil || l.N < 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q: bad number of requests", s)
+	}
+	if l.Per, err = time.ParseDuration(per); err != nil || l.Per <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q: bad period", s)
+	}
+	return l, nil
+}
+
+// window returns the index of the window containing t, and when the next
+// one starts.
+func (l Limit) window(t time.Time) (int64, time.Time) {
+	i := t.UnixNano() / int64(l.Per)
+	return i, time.Unix(0, (i+1)*int64(l.Per))
+}
+
+// memoryRateLimiter counts requests in memory, so each instance enforces
+// limits separately.
+type memoryRateLimiter struct {
+	mu     sync.Mutex
+	counts map[string]*windowCount
+}
+
+type windowCount struct {
+	window int64
+	n      int
+}
+
+// NewMemoryRateLimiter returns a RateLimiter that counts requests in memory,
+// so that limits apply to each instance separately.
+func NewMemoryRateLimiter() RateLimiter {
+	return &memoryRateLimiter{counts: map[string]*windowCount{}}
+}
+
+func (m *memoryRateLimiter) Take(_ context.Context, budget, client string, limit Limit) (time.Duration, error) {
+	now := time.Now()
+	w, next := limit.window(now)
+	key := budget + "/" + client
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.counts[key]
+	if !ok || c.window != w {
+		// Forget about clients from past windows.
+		if len(m.counts) > 10000 {
+			for k, c := range m.counts {
+				if c.window < w {
+					delete(m.counts, k)
+				}
+			}
+		}
+		c = &windowCount{window: w}
+		m.counts[key] = c
+	}
+	if c.n >= limit.N {
+		return next.Sub(now), nil
+	}
+	c.n++
+	return 0, nil
+}
+
+// storageRateLimiter counts requests in Storage, so that limits apply across
+// instances.
+type storageRateLimiter struct{ st Storage }
+
+// NewStorageRateLimiter returns a RateLimiter that counts requests in
+// Storage, so that limits apply across every instance sharing it.
+//
+// Each client's count in each window is an object named
+// "ratelimit-<budget>-<client>-<window>", where the client is hashed, which
+// is incremented using generation preconditions so that concurrent requests
+// aren't lost. Every request reads and writes the object, so it's best suited
+// to budgets with small limits, like builds. Objects expire with age, like
+// other objects written by WriteObject.
+func NewStorageRateLimiter(st Storage) RateLimiter {
+	return &storageRateLimiter{st: st}
+}
+
+// maxCountAttempts is how many times a count is retried when other requests
+// by the same client update it concurrently.
+const maxCountAttempts = 10
+
+func (s *storageRateLimiter) Take(ctx context.Context, budget, client string, limit Limit) (time.Duration, error) {
+	now := time.Now()
+	w, next := limit.window(now)
+	name := fmt.Sprintf("ratelimit-%s-%x-%d", budget, md5.Sum([]byte(client)), w)
+
+	for range maxCountAttempts {
+		n, gen := 0, int64(0)
+		contents, g, err := s.st.readObject(ctx, name)
+		switch {
+		case err == nil:
+			if n, err = strconv.Atoi(contents); err != nil {
+				return 0, fmt.Errorf("parsing count %q: %w", name, err)
+			}
+			gen = g
+		case !isNotExist(err):
+			return 0, fmt.Errorf("reading count: %w", err)
+		}
+		if n >= limit.N {
+			return next.Sub(now), nil
+		}
+		if _, err := s.st.putObject(ctx, name, strconv.Itoa(n+1), gen); errors.Is(err, errConflict) {
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("recording request: %w", err)
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("recording request: %q changed %d times", name, maxCountAttempts)
+}
+
+// RateLimits limits how often each client, identified by its authenticated
+// identity or else its IP address, can make requests.
+type RateLimits struct {
+	// Requests, if non-zero, limits every request for a repository,
+	// including cheap ones like pulling cached manifests and blobs.
+	Requests Limit
+	// Builds, if non-zero, limits requests that start a build because the
+	// requested image isn't cached, since those are much more expensive.
+	Builds Limit
+	// Limiter counts requests.
+	Limiter RateLimiter
+}
+
+// NewRateLimits returns RateLimits configured by the environment, or nil if
+// no limits are configured:
+//
+//   - $RATE_LIMIT_REQUESTS limits every request, like 600/1m.
+//   - $RATE_LIMIT_BUILDS limits requests that start a build, like 10/1h.
+//   - $RATE_LIMIT_STORAGE, if true, counts requests in st so that limits
+//     apply across instances. Otherwise, each instance counts requests in
+//     memory.
+func NewRateLimits(st Storage) (*RateLimits, error) {
+	rl := &RateLimits{}
+	var err error
+	if v := os.Getenv("RATE_LIMIT_REQUESTS"); v != "" {
+		if rl.Requests, err = ParseLimit(v); err != nil {
+			return nil, fmt.Errorf("parsing $RATE_LIMIT_REQUESTS: %w", err)
+		}
+	}
+	if v := os.Getenv("RATE_LIMIT_BUILDS"); v != "" {
+		if rl.Builds, err = ParseLimit(v); err != nil {
+			return nil, fmt.Errorf("parsing $RATE_LIMIT_BUILDS: %w", err)
+		}
+	}
+	if rl.Requests == (Limit{}) && rl.Builds == (Limit{}) {
+		return nil, nil
+	}
+	if ok, _ := strconv.ParseBool(os.Getenv("RATE_LIMIT_STORAGE")); ok {
+		rl.Limiter = NewStorageRateLimiter(st)
+	} else {
+		rl.Limiter = NewMemoryRateLimiter()
+	}
+	return rl, nil
+}
+
+var (
+	defaultRateLimitsOnce sync.Once
+	defaultRateLimits     *RateLimits
+	defaultRateLimitsErr  error
+)
+
+// rateLimits returns the RateLimits the Router enforces, or nil if there are
+// none.
+func (rt *Router) rateLimits() (*RateLimits, error) {
+	if rt.RateLimits != nil {
+		return rt.RateLimits, nil
+	}
+	defaultRateLimitsOnce.Do(func() {
+		defaultRateLimits, defaultRateLimitsErr = NewRateLimits(rt.Storage)
+	})
+	return defaultRateLimits, defaultRateLimitsErr
+}
+
+type rateLimitsKey struct{}
+
+// clientID identifies the client making the request, by its authenticated
+// identity if it has one, or else by its IP address. Behind a proxy, like
+// Cloud Run's, the address is the last one in X-Forwarded-For, which the
+// proxy appended.
+//
+// The identity comes from ctx rather than r, since the request stored in a
+// build's context by the Router predates authentication.
+func clientID(ctx context.Context, r *http.Request) string {
+	if user := IdentityFromContext(ctx); user != "" {
+		return "user:" + user
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		addrs := strings.Split(xff, ",")
+		return "ip:" + strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// take records a request against the budget, and returns a TOOMANYREQUESTS
+// error if the client has exceeded it. If the request can't be recorded, it's
+// allowed.
+func (rl *RateLimits) take(ctx context.Context, r *http.Request, budget string, limit Limit) error {
+	if limit == (Limit{}) {
+		return nil
+	}
+	client := clientID(ctx, r)
+	after, err := rl.Limiter.Take(ctx, budget, client, limit)
+	if err != nil {
+		slog.WarnContext(ctx, "rate limiting", "budget", budget, "client", client, "err", err)
+		return nil
+	}
+	if after > 0 {
+		rateLimited.WithLabelValues(budget).Inc()
+		return Retryable(TooManyRequests, after, "%s exceeded the limit of %d %s per %s", client, limit.N, budget, limit.Per)
+	}
+	return nil
+}
+
+// limitRequest records a request against the Router's request budget, and
+// returns the request with the RateLimits in its context, so that Build can
+// enforce the build budget.
+func (rt *Router) limitRequest(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	ctx := r.Context()
+	rl, err := rt.rateLimits()
+	if err != nil {
+		slog.ErrorContext(ctx, "NewRateLimits", "err", err)
+		Error(w, err)
+		return nil, false
+	}
+	if rl == nil {
+		return r, true
+	}
+	if err := rl.take(ctx, r, "requests", rl.Requests); err != nil {
+		Error(w, err)
+		return nil, false
+	}
+	return r.WithContext(context.WithValue(ctx, rateLimitsKey{}, rl)), true
+}
+
+// ChargeBuild records a build started by the request being served against
+// the build budget, if the Router serving it has one, and returns a
+// TOOMANYREQUESTS error if the client has exceeded it. Build and BuildAsync
+// charge for the builds they start; services that generate images some other
+// way, like random and wait, must charge for them themselves.
+func ChargeBuild(ctx context.Context) error {
+	rl, _ := ctx.Value(rateLimitsKey{}).(*RateLimits)
+	r := RequestFromContext(ctx)
+	if rl == nil || r == nil {
+		return nil
+	}
+	return rl.take(ctx, r, "builds", rl.Builds)
+}
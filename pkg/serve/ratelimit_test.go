@@ -0,0 +1,184 @@
+package serve
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestLimitWindow(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		per      time.Duration
+		t        time.Time
+		wantNext time.Time
+	}{
+		{time.Hour, base, base.Add(time.Hour)},
+		{time.Hour, base.Add(time.Hour - time.Nanosecond), base.Add(time.Hour)},
+		{time.Hour, base.Add(90 * time.Minute), base.Add(2 * time.Hour)},
+		{time.Minute, base.Add(90 * time.Second), base.Add(2 * time.Minute)},
+	} {
+		l := Limit{N: 1, Per: c.per}
+		w, next := l.window(c.t)
+		if !next.Equal(c.wantNext) {
+			t.Errorf("window(%s) per %s: got next %s, want %s", c.t, c.per, next, c.wantNext)
+		}
+		// Every time in the window has the same index.
+		if w2, _ := l.window(next.Add(-time.Nanosecond)); w2 != w {
+			t.Errorf("window(%s) per %s: got index %d at end of window, want %d", c.t, c.per, w2, w)
+		}
+		if w3, _ := l.window(next); w3 != w+1 {
+			t.Errorf("window(%s) per %s: got index %d in next window, want %d", c.t, c.per, w3, w+1)
+		}
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	for _, c := range []struct {
+		in      string
+		want    Limit
+		wantErr bool
+	}{
+		{in: "600/1m", want: Limit{N: 600, Per: time.Minute}},
+		{in: "0/1h", want: Limit{N: 0, Per: time.Hour}},
+		{in: "10", wantErr: true},
+		{in: "-1/1h", wantErr: true},
+		{in: "10/0s", wantErr: true},
+		{in: "10/forever", wantErr: true},
+	} {
+		got, err := ParseLimit(c.in)
+		if (err != nil) != c.wantErr || got != c.want {
+			t.Errorf("ParseLimit(%q): got %+v, %v; want %+v, error %t", c.in, got, err, c.want, c.wantErr)
+		}
+	}
+}
+
+func TestRateLimiters(t *testing.T) {
+	limit := Limit{N: 3, Per: time.Hour}
+	for name, newLimiter := range map[string]func() RateLimiter{
+		"memory":  NewMemoryRateLimiter,
+		"storage": func() RateLimiter { return NewStorageRateLimiter(NewMemoryStorage()) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			rl := newLimiter()
+
+			// Concurrent requests are all counted.
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			allowed := 0
+			for range limit.N + 2 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					after, err := rl.Take(ctx, "builds", "alice", limit)
+					if err != nil {
+						t.Errorf("Take: %v", err)
+						return
+					}
+					if after < 0 || after > limit.Per {
+						t.Errorf("Take: got retry after %s, want up to %s", after, limit.Per)
+					}
+					if after == 0 {
+						mu.Lock()
+						allowed++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if allowed != limit.N {
+				t.Errorf("allowed %d requests, want %d", allowed, limit.N)
+			}
+
+			// Other clients and budgets are counted separately.
+			for _, c := range []struct{ budget, client string }{
+				{"builds", "bob"},
+				{"requests", "alice"},
+			} {
+				if after, err := rl.Take(ctx, c.budget, c.client, limit); err != nil || after != 0 {
+					t.Errorf("Take(%s, %s): got %s, %v; want allowed", c.budget, c.client, after, err)
+				}
+			}
+		})
+	}
+}
+
+func TestChargeBuild(t *testing.T) {
+	builds := 0
+	rt := &Router{
+		Storage: NewMemoryStorage(),
+		RateLimits: &RateLimits{
+			Builds:  Limit{N: 1, Per: time.Hour},
+			Limiter: NewMemoryRateLimiter(),
+		},
+		ResolveManifest: func(ctx context.Context, repo, tag string) (string, error) {
+			if err := ChargeBuild(ctx); err != nil {
+				return "", err
+			}
+			builds++
+			return "", Errorf(ManifestUnknown, "not built")
+		},
+	}
+	for i, want := range []int{http.StatusNotFound, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/foo/manifests/latest", nil))
+		if rec.Code != want {
+			t.Errorf("request %d: got status %d, want %d: %s", i, rec.Code, want, rec.Body)
+		}
+	}
+	if builds != 1 {
+		t.Errorf("got %d builds, want 1", builds)
+	}
+}
+
+func TestBuildCharges(t *testing.T) {
+	st := NewMemoryStorage()
+	builds := 0
+	rt := &Router{
+		Storage: st,
+		RateLimits: &RateLimits{
+			Builds:  Limit{N: 1, Per: time.Hour},
+			Limiter: NewMemoryRateLimiter(),
+		},
+		ResolveManifest: func(ctx context.Context, repo, tag string) (string, error) {
+			ck := "build-" + repo
+			return ck, Build(ctx, st, ck, func(ctx context.Context) error {
+				builds++
+				img, err := random.Image(100, 1)
+				if err != nil {
+					return err
+				}
+				return WriteImage(ctx, st, img, ck)
+			})
+		},
+	}
+	for _, c := range []struct {
+		repo string
+		want int
+	}{
+		{"foo", http.StatusOK},
+		// Cached images aren't charged for.
+		{"foo", http.StatusOK},
+		{"bar", http.StatusTooManyRequests},
+	} {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/"+c.repo+"/manifests/latest", nil))
+		if rec.Code != c.want {
+			t.Errorf("GET %s: got status %d, want %d: %s", c.repo, rec.Code, c.want, rec.Body)
+		}
+	}
+	if builds != 1 {
+		t.Errorf("got %d builds, want 1", builds)
+	}
+	// The lease isn't left held when the client is over its budget.
+	if leaseHeld(context.Background(), st, "build-bar") {
+		t.Error("lease for build-bar is still held")
+	}
+}
@@ -0,0 +1,243 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// fallbackTagRE matches tags in the referrers tag schema, <alg>-<hex>, which
+// clients that don't support the referrers API use to find referrers.
+var fallbackTagRE = regexp.MustCompile(`^(sha256|sha512)-([0-9a-f]{64}|[0-9a-f]{128})$`)
+
+// Each manifest with a subject is indexed by an object named
+// "referrers-<subject>-<digest>", containing the manifest's descriptor as it
+// should appear in the subject's referrers list.
+func referrersPrefix(subject v1.Hash) string {
+	return fmt.Sprintf("%s%s-", referrersPrefixAll, subject)
+}
+
+// referrersPrefixAll prefixes the index entries of every subject.
+const referrersPrefixAll = "referrers-"
+
+// parseReferrerName returns the subject and referrer digests of an index
+// entry's name.
+func parseReferrerName(name string) (subject, referrer v1.Hash, ok bool) {
+	rest, ok := strings.CutPrefix(name, referrersPrefixAll)
+	if !ok {
+		return v1.Hash{}, v1.Hash{}, false
+	}
+	s, r, ok := strings.Cut(rest, "-")
+	if !ok {
+		return v1.Hash{}, v1.Hash{}, false
+	}
+	subject, err := v1.NewHash(s)
+	if err != nil {
+		return v1.Hash{}, v1.Hash{}, false
+	}
+	referrer, err = v1.NewHash(r)
+	if err != nil {
+		return v1.Hash{}, v1.Hash{}, false
+	}
+	return subject, referrer, true
+}
+
+// referrerManifest holds the fields of an image manifest or index that
+// describe it as a referrer.
+type referrerManifest struct {
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Config       v1.Descriptor     `json:"config"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Subject      *v1.Descriptor    `json:"subject,omitempty"`
+}
+
+// indexReferrer records the manifest described by desc, with contents b, as a
+// referrer of its subject, if it has one. It returns the subject's digest,
+// or the zero Hash if it has none.
+func indexReferrer(ctx context.Context, st Storage, desc v1.Descriptor, b []byte) (v1.Hash, error) {
+	var m referrerManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return v1.Hash{}, err
+	}
+	if m.Subject == nil {
+		return v1.Hash{}, nil
+	}
+	d := v1.Descriptor{
+		MediaType:    desc.MediaType,
+		Digest:       desc.Digest,
+		Size:         desc.Size,
+		ArtifactType: m.ArtifactType,
+		Annotations:  m.Annotations,
+	}
+	// Per the spec, an image manifest without an artifactType is
+	// described by its config's media type.
+	if d.ArtifactType == "" && desc.MediaType.IsImage() {
+		d.ArtifactType = string(m.Config.MediaType)
+	}
+	return m.Subject.Digest, addReferrer(ctx, st, m.Subject.Digest, d)
+}
+
+// addReferrer lists the manifest described by d among the subject's
+// referrers.
+func addReferrer(ctx context.Context, st Storage, subject v1.Hash, d v1.Descriptor) error {
+	j, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return st.WriteObject(ctx, referrersPrefix(subject)+d.Digest.String(), string(j))
+}
+
+// fallbackSubject returns the subject digest for a tag in the referrers tag
+// schema.
+func fallbackSubject(tag string) (v1.Hash, bool) {
+	if !fallbackTagRE.MatchString(tag) {
+		return v1.Hash{}, false
+	}
+	alg, hex, _ := strings.Cut(tag, "-")
+	h, err := v1.NewHash(alg + ":" + hex)
+	return h, err == nil
+}
+
+// referrers returns descriptors for the manifests whose subject is the given
+// digest, optionally only those with the given artifact type.
+func referrers(ctx context.Context, st Storage, subject v1.Hash, artifactType string) ([]v1.Descriptor, error) {
+	objs, err := st.list(ctx, referrersPrefix(subject))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Name < objs[j].Name })
+
+	var mu sync.Mutex
+	out := []v1.Descriptor{}
+	var g errgroup.Group
+	g.SetLimit(10)
+	for _, o := range objs {
+		o := o
+		g.Go(func() error {
+			rc, err := st.readBlob(ctx, o.Name)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			var d v1.Descriptor
+			if err := json.NewDecoder(rc).Decode(&d); err != nil {
+				return fmt.Errorf("reading %q: %w", o.Name, err)
+			}
+			if artifactType != "" && d.ArtifactType != artifactType {
+				return nil
+			}
+			mu.Lock()
+			out = append(out, d)
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Digest.String() < out[j].Digest.String() })
+	return out, nil
+}
+
+// referrersIndex returns an OCI image index listing the referrers.
+func referrersIndex(descs []v1.Descriptor) ([]byte, error) {
+	return json.Marshal(v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     descs,
+	})
+}
+
+// serveReferrers serves the referrers API, listing the manifests whose
+// subject is the digest, filtered by the artifactType query parameter. The
+// subject must be in the repository, and its referrers are linked to it.
+func (rt *Router) serveReferrers(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	ctx := r.Context()
+	h, err := v1.NewHash(ref)
+	if err != nil {
+		Error(w, Errorf(DigestInvalid, "invalid digest %q: %w", ref, err))
+		return
+	}
+	if !rt.linked(ctx, repo, h) {
+		Error(w, Errorf(ManifestUnknown, "manifest %s not found in %s", h, repo))
+		return
+	}
+	artifactType := r.URL.Query().Get("artifactType")
+	descs, err := referrers(ctx, rt.Storage, h, artifactType)
+	if err != nil {
+		slog.ErrorContext(ctx, "referrers", "subject", h, "err", err)
+		Error(w, err)
+		return
+	}
+	// Referrers are linked for as long as their subject is.
+	expires := rt.linkExpiry(ctx, repo, h)
+	for _, d := range descs {
+		if err := rt.linkManifest(ctx, repo, d.Digest, expires); err != nil {
+			slog.ErrorContext(ctx, "linkManifest", "repo", repo, "digest", d.Digest, "err", err)
+			Error(w, err)
+			return
+		}
+	}
+	b, err := referrersIndex(descs)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Type", string(types.OCIImageIndex))
+	w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(b)
+}
+
+// serveReferrersTag serves the index of referrers for a tag in the referrers
+// tag schema, for clients that don't support the referrers API. The index is
+// stored by digest so that it can be fetched again by digest.
+func (rt *Router) serveReferrersTag(w http.ResponseWriter, r *http.Request, repo string, subject v1.Hash) {
+	ctx := r.Context()
+	if !rt.linked(ctx, repo, subject) {
+		Error(w, Errorf(ManifestUnknown, "no referrers found for %s", subject))
+		return
+	}
+	descs, err := referrers(ctx, rt.Storage, subject, "")
+	if err != nil {
+		slog.ErrorContext(ctx, "referrers", "subject", subject, "err", err)
+		Error(w, err)
+		return
+	}
+	if len(descs) == 0 {
+		Error(w, Errorf(ManifestUnknown, "no referrers found for %s", subject))
+		return
+	}
+	b, err := referrersIndex(descs)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	h, size, err := v1.SHA256(bytes.NewReader(b))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if err := rt.Storage.writeBlob(ctx, h.String(), h, size, io.NopCloser(bytes.NewReader(b)), string(types.OCIImageIndex)); err != nil {
+		Error(w, err)
+		return
+	}
+	rt.serveManifestBlob(w, r, repo, h.String(), false)
+}
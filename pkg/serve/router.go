@@ -0,0 +1,291 @@
+package serve
+
+import (
+	"context"
+	"crypto"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Router serves the registry API described by the OCI distribution spec,
+// serving blobs and manifests by digest from Storage, and resolving
+// manifests by tag using ResolveManifest. It also serves the status of builds
+// started by BuildAsync at /status/<cache key>, build logs at
+// /logs/<cache key>, and images recorded by RecordBuild at /v2/_catalog and
+// /catalog. If PushManifest is set, it also accepts pushes.
+//
+// Manifests with a subject are listed by the referrers API, and by the
+// referrers tag schema for clients that don't support it.
+//
+// If Auth is set, or configured by the environment, every request except
+// those for /cosign.pub and Fallback must be authenticated, and requests for
+// a repository must be allowed by its access rules.
+type Router struct {
+	Storage Storage
+
+	// Service names the service, whose images recorded by RecordBuild are
+	// listed at /v2/_catalog and /catalog. If it's empty, the images of
+	// every service are listed.
+	Service string
+
+	// ResolveManifest is called to resolve a manifest request for a tag in
+	// a repository. It returns the name of the blob in Storage containing
+	// the manifest, which is then served to the client.
+	ResolveManifest func(ctx context.Context, repo, tag string) (string, error)
+
+	// ResolveDigests, if true, passes manifest requests by digest to
+	// ResolveManifest if the manifest isn't already in Storage.
+	ResolveDigests bool
+
+	// PushManifest, if set, enables pushes. Pushed blobs are stored by
+	// digest, and pushed manifests are stored by digest once everything
+	// they reference is stored, then passed to PushManifest along with
+	// the repository and tag or digest they were pushed to.
+	PushManifest func(ctx context.Context, repo, ref string, desc v1.Descriptor) error
+
+	// ListTags, if set, is called to list the tags in a repository, which
+	// are served at tags/list. The Router sorts and paginates them.
+	ListTags func(ctx context.Context, repo string) ([]string, error)
+
+	// Signer, if set, is the signer passed to SignImage, whose public key
+	// is served at /cosign.pub so clients can verify signatures.
+	Signer crypto.Signer
+
+	// RateLimits, if set, limits how often each client can make requests
+	// and start builds. If it's nil, the RateLimits returned by
+	// NewRateLimits are used, if any.
+	RateLimits *RateLimits
+
+	// Auth, if set, authenticates clients. If it's nil, the Auth returned
+	// by NewAuth is used, if any, so services configured with credentials
+	// always require them.
+	Auth *Auth
+
+	// Fallback handles requests outside of /v2/, /status/, /logs/ and
+	// /catalog. If it's nil, those requests get a 404.
+	Fallback http.Handler
+}
+
+var (
+	// Repository names, per the distribution spec. The first component is
+	// also allowed to include a port, so that references to registries
+	// like localhost:5000/foo can be mirrored.
+	nameRE = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(:[0-9]+)?(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	tagRE  = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+type requestKey struct{}
+
+// RequestFromContext returns the request being served by a Router, if any.
+func RequestFromContext(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(requestKey{}).(*http.Request)
+	return r
+}
+
+type repoKey struct{}
+
+// repoRef names a repository of a service.
+type repoRef struct {
+	Service string `json:"service,omitempty"`
+	Repo    string `json:"repo,omitempty"`
+}
+
+// repoFromContext returns the repository requested by the request being
+// served by a Router, if any, which is the repository that builds started
+// while serving it belong to.
+func repoFromContext(ctx context.Context) repoRef {
+	ref, _ := ctx.Value(repoKey{}).(repoRef)
+	return ref
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Status, logs and the catalog are served to authenticated users, who
+	// are then authorized for the repositories they belong to.
+	var h http.HandlerFunc
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/status/"):
+		h = rt.serveStatus
+	case strings.HasPrefix(r.URL.Path, "/logs/"):
+		h = rt.serveLogs
+	case r.URL.Path == "/catalog":
+		h = rt.serveCatalogEntries
+	case r.URL.Path == "/token":
+		rt.serveToken(w, r)
+		return
+	case r.URL.Path == "/cosign.pub" && rt.Signer != nil:
+		rt.servePublicKey(w, r)
+		return
+	}
+	if h != nil {
+		if r, ok := rt.authorize(w, r, scope{}); ok {
+			h(w, r)
+		}
+		return
+	}
+	if r.URL.Path != "/v2" && !strings.HasPrefix(r.URL.Path, "/v2/") {
+		if rt.Fallback != nil {
+			rt.Fallback.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2"), "/")
+	if path == "" {
+		// API Version check, which also tells clients whether they need
+		// to authenticate.
+		rt.authorize(w, r, scope{})
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), requestKey{}, r)
+	r = r.WithContext(ctx)
+
+	if path == "_catalog" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			Error(w, Errorf(Unsupported, "method %s not allowed", r.Method))
+			return
+		}
+		r, ok := rt.authorize(w, r, catalogScope)
+		if !ok {
+			return
+		}
+		if r, ok := rt.limitRequest(w, r); ok {
+			rt.serveCatalog(w, r)
+		}
+		return
+	}
+
+	// Paths are of the form <name>/<kind>/<ref>, where name can contain
+	// slashes, except for blob uploads.
+	parts := strings.Split(path, "/")
+	if repo, id, ok := uploadPath(parts); ok {
+		if rt.PushManifest == nil {
+			Error(w, Errorf(Unsupported, "pushes are not supported"))
+			return
+		}
+		if !nameRE.MatchString(repo) {
+			Error(w, Errorf(NameInvalid, "invalid repository name %q", repo))
+			return
+		}
+		r, ok := rt.authorize(w, r, repoScope(repo, "pull", "push"))
+		if !ok {
+			return
+		}
+		if r, ok := rt.limitRequest(w, r); ok {
+			rt.serveUpload(w, r, repo, id)
+		}
+		return
+	}
+
+	push := r.Method == http.MethodPut && rt.PushManifest != nil
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !push {
+		Error(w, Errorf(Unsupported, "method %s not allowed", r.Method))
+		return
+	}
+	if len(parts) < 3 {
+		Error(w, Errorf(NameUnknown, "unknown path %q", r.URL.Path))
+		return
+	}
+	repo := strings.Join(parts[:len(parts)-2], "/")
+	kind, ref := parts[len(parts)-2], parts[len(parts)-1]
+	if !nameRE.MatchString(repo) {
+		Error(w, Errorf(NameInvalid, "invalid repository name %q", repo))
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), repoKey{}, repoRef{Service: rt.Service, Repo: repo}))
+	need := repoScope(repo, "pull")
+	if push {
+		need = repoScope(repo, "pull", "push")
+	}
+	r, ok := rt.authorize(w, r, need)
+	if !ok {
+		return
+	}
+	if r, ok = rt.limitRequest(w, r); !ok {
+		return
+	}
+
+	switch {
+	case push && kind == "manifests":
+		rt.putManifest(w, r, repo, ref)
+	case push:
+		Error(w, Errorf(Unsupported, "method %s not allowed", r.Method))
+	case kind == "blobs":
+		h, err := v1.NewHash(ref)
+		if err != nil {
+			Error(w, Errorf(DigestInvalid, "invalid digest %q: %w", ref, err))
+			return
+		}
+		if !rt.linked(r.Context(), repo, h) {
+			Error(w, Errorf(BlobUnknown, "blob %s not found in %s", h, repo))
+			return
+		}
+		rt.Storage.ServeBlob(w, r, ref)
+	case kind == "manifests":
+		rt.serveManifest(w, r, repo, ref)
+	case kind == "referrers":
+		rt.serveReferrers(w, r, repo, ref)
+	case kind == "tags" && ref == "list":
+		rt.serveTags(w, r, repo)
+	default:
+		Error(w, Errorf(NameUnknown, "unknown path %q", r.URL.Path))
+	}
+}
+
+func (rt *Router) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	ctx := r.Context()
+
+	if strings.Contains(ref, ":") {
+		h, err := v1.NewHash(ref)
+		if err != nil {
+			Error(w, Errorf(DigestInvalid, "invalid digest %q: %w", ref, err))
+			return
+		}
+		// If we have the manifest by digest, and it's in the
+		// repository, serve it.
+		if _, err := rt.Storage.BlobExists(ctx, ref); err == nil && rt.linked(ctx, repo, h) {
+			rt.serveManifestBlob(w, r, repo, ref, false)
+			return
+		} else if !rt.ResolveDigests {
+			slog.InfoContext(ctx, "storage.BlobExists", "digest", ref, "err", err)
+			Error(w, ErrNotFound)
+			return
+		}
+	} else if !tagRE.MatchString(ref) {
+		Error(w, Errorf(TagInvalid, "invalid tag %q", ref))
+		return
+	} else if subject, ok := fallbackSubject(ref); ok {
+		rt.serveReferrersTag(w, r, repo, subject)
+		return
+	} else if cosignTagRE.MatchString(ref) {
+		// Artifacts are only served for images in the repository.
+		tag, _, _ := strings.Cut(ref, ".")
+		if subject, _ := fallbackSubject(tag); !rt.linked(ctx, repo, subject) {
+			Error(w, Errorf(ManifestUnknown, "no artifact found for %s", ref))
+			return
+		}
+		if _, err := rt.Storage.BlobExists(ctx, cosignName(ref)); err == nil {
+			rt.serveManifestBlob(w, r, repo, cosignName(ref), false)
+			return
+		} else if rt.PushManifest == nil {
+			Error(w, Errorf(ManifestUnknown, "no artifact found for %s", ref))
+			return
+		}
+		// Otherwise, the artifact may have been pushed to the tag.
+	}
+
+	name, err := rt.ResolveManifest(ctx, repo, ref)
+	if err != nil {
+		slog.ErrorContext(ctx, "ResolveManifest", "repo", repo, "ref", ref, "err", err)
+		Error(w, err)
+		return
+	}
+	rt.serveManifestBlob(w, r, repo, name, true)
+}
@@ -3,19 +3,19 @@ package serve
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/chainguard-dev/terraform-infra-common/pkg/httpmetrics"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/types"
 	"golang.org/x/sync/errgroup"
-	"google.golang.org/api/googleapi"
 )
 
 func init() {
@@ -23,102 +23,140 @@ func init() {
 	go httpmetrics.ServeMetrics()
 }
 
-var bucket = os.Getenv("BUCKET")
+// Storage stores blobs and manifests, and serves them to clients.
+type Storage interface {
+	// BlobExists returns a descriptor for the named blob, or an error if
+	// it doesn't exist.
+	BlobExists(ctx context.Context, name string) (v1.Descriptor, error)
 
-func Blob(w http.ResponseWriter, r *http.Request, name string) {
-	url := fmt.Sprintf("https://storage.googleapis.com/%s/blobs/%s", bucket, name)
-	http.Redirect(w, r, url, http.StatusSeeOther)
-}
+	// WriteObject writes contents to the named object, unless it already
+	// exists.
+	WriteObject(ctx context.Context, name, contents string) error
 
-type Storage struct {
-	client *storage.Client
-}
+	// ServeBlob serves the named blob, either by redirecting to it or by
+	// serving its contents directly.
+	ServeBlob(w http.ResponseWriter, r *http.Request, name string)
 
-func NewStorage(ctx context.Context) (*Storage, error) {
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("NewClient: %v", err)
-	}
-	return &Storage{client}, nil
+	// createObject writes contents to the named object, or returns
+	// errExists if it already exists.
+	createObject(ctx context.Context, name, contents string) error
+
+	// putObject writes contents to the named object if its generation is
+	// generation, or if it doesn't exist and generation is 0, and returns
+	// its new generation. Otherwise it returns errConflict.
+	putObject(ctx context.Context, name, contents string, generation int64) (int64, error)
+
+	// readObject returns the contents of the named object written by
+	// createObject or putObject, along with its generation.
+	readObject(ctx context.Context, name string) (string, int64, error)
+
+	// deleteIf deletes the named object if its generation is generation,
+	// and returns errConflict otherwise.
+	deleteIf(ctx context.Context, name string, generation int64) error
+
+	// readBlob returns the contents of the named blob.
+	readBlob(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// stat returns information about the named blob.
+	stat(ctx context.Context, name string) (objectInfo, error)
+
+	// list returns information about all stored blobs whose names start
+	// with prefix.
+	list(ctx context.Context, prefix string) ([]objectInfo, error)
+
+	// delete deletes the named blob.
+	delete(ctx context.Context, name string) error
+
+	// setExpiry records when the named blob expires. Expired blobs are
+	// deleted by CollectGarbage.
+	setExpiry(ctx context.Context, name string, t time.Time) error
+
+	// writeBlob writes the contents of rc to the named blob, unless it
+	// already exists. If the contents don't have digest h and the given
+	// size (or any size, if size is -1), nothing is written and an error
+	// wrapping ErrDigestMismatch is returned. If h is the zero Hash, only
+	// the size is checked, and no digest is recorded.
+	writeBlob(ctx context.Context, name string, h v1.Hash, size int64, rc io.ReadCloser, contentType string) error
 }
 
-func (s *Storage) BlobExists(ctx context.Context, name string) (v1.Descriptor, error) {
-	obj, err := s.client.Bucket(bucket).Object(fmt.Sprintf("blobs/%s", name)).Attrs(ctx)
-	if err != nil {
-		return v1.Descriptor{}, err
-	}
-	var h v1.Hash
-	if d := obj.Metadata["Docker-Content-Digest"]; d != "" {
-		h, err = v1.NewHash(d)
-		if err != nil {
-			return v1.Descriptor{}, err
-		}
+// errExists is returned by createObject if the object already exists.
+var errExists = errors.New("object already exists")
+
+// errConflict is returned by putObject and deleteIf if the object was
+// changed since its generation was read.
+var errConflict = errors.New("object was modified concurrently")
+
+func ignoreExists(err error) error {
+	if errors.Is(err, errExists) {
+		return nil
 	}
+	return err
+}
 
-	return v1.Descriptor{
-		Digest:    h,
-		MediaType: types.MediaType(obj.ContentType),
-		Size:      obj.Size,
-	}, nil
+// isNotExist reports whether err means an object doesn't exist, as opposed
+// to a transient error reading it.
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, storage.ErrObjectNotExist)
 }
 
-func (s *Storage) WriteObject(ctx context.Context, name, contents string) error {
-	w := s.client.Bucket(bucket).Object(fmt.Sprintf("blobs/%s", name)).
-		If(storage.Conditions{DoesNotExist: true}).
-		NewWriter(ctx)
-	if _, err := fmt.Fprintln(w, contents); err != nil {
-		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
-			return nil
-		}
-		return fmt.Errorf("fmt.Fprintln: %v", err)
-	}
-	if err := w.Close(); err != nil {
-		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
-			return nil
-		}
-		return fmt.Errorf("w.Close: %v", err)
-	}
-	return nil
+// objectInfo describes a stored blob.
+type objectInfo struct {
+	Name    string
+	Created time.Time
+	// Expires is when the blob expires, or zero if it only expires with
+	// age.
+	Expires time.Time
+	v1.Descriptor
 }
 
-func (s *Storage) writeBlob(ctx context.Context, name string, h v1.Hash, rc io.ReadCloser, contentType string) error {
-	start := time.Now()
-	defer func() { log.Printf("writeBlob(%q) took %s", name, time.Since(start)) }()
+// NewStorage returns a Storage backed by the local directory named by
+// $STORAGE_DIR if it's set, or otherwise by the GCS bucket named by $BUCKET.
+//
+// If $PROXY_BLOBS is true, blobs in GCS are streamed through the service
+// instead of redirecting clients to the bucket.
+//
+// If $SIGN_URLS is true, clients are redirected to GCS V4 signed URLs, or if
+// $CDN_BASE_URL is set, to Cloud CDN signed URLs using the key named by
+// $CDN_KEY_NAME with the value $CDN_KEY. Signed URLs expire after
+// $SIGNED_URL_EXPIRY (default 15m).
+func NewStorage(ctx context.Context) (Storage, error) {
+	if dir := os.Getenv("STORAGE_DIR"); dir != "" {
+		return NewLocalStorage(dir)
+	}
+	bucket := os.Getenv("BUCKET")
+	proxy, _ := strconv.ParseBool(os.Getenv("PROXY_BLOBS"))
+	opts := []GCSOption{WithProxy(proxy)}
 
-	// The DoesNotExist precondition can be hit when writing or flushing
-	// data, which can happen any of three places. Anywhere it happens,
-	// just ignore the error since that means the blob already exists.
-	w := s.client.Bucket(bucket).Object(fmt.Sprintf("blobs/%s", name)).
-		If(storage.Conditions{DoesNotExist: true}).
-		NewWriter(ctx)
-	w.ObjectAttrs.ContentType = contentType
-	w.Metadata = map[string]string{"Docker-Content-Digest": h.String()}
-	if _, err := io.Copy(w, rc); err != nil {
-		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
-			return nil
+	expiry := defaultSignedURLExpiry
+	if e := os.Getenv("SIGNED_URL_EXPIRY"); e != "" {
+		var err error
+		expiry, err = time.ParseDuration(e)
+		if err != nil {
+			return nil, fmt.Errorf("parsing $SIGNED_URL_EXPIRY: %v", err)
 		}
-		return fmt.Errorf("Copy: %v", err)
 	}
-	if err := rc.Close(); err != nil {
-		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
-			return nil
+	if base := os.Getenv("CDN_BASE_URL"); base != "" {
+		signer, err := NewCDNSigner(base, os.Getenv("CDN_KEY_NAME"), os.Getenv("CDN_KEY"))
+		if err != nil {
+			return nil, err
 		}
-		return fmt.Errorf("rc.Close: %v", err)
-	}
-	if err := w.Close(); err != nil {
-		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
-			return nil
+		opts = append(opts, WithSignedURLs(signer, expiry))
+	} else if sign, _ := strconv.ParseBool(os.Getenv("SIGN_URLS")); sign {
+		signer, err := NewV4Signer(ctx, bucket)
+		if err != nil {
+			return nil, err
 		}
-		return fmt.Errorf("w.Close: %v", err)
+		opts = append(opts, WithSignedURLs(signer, expiry))
 	}
-	return nil
+	return NewGCSStorage(ctx, bucket, opts...)
 }
 
-// ServeIndex writes manifest, config and layer blobs for each image in the
-// index, then writes and redirects to the index manifest contents pointing to
-// those blobs.
-func (s *Storage) ServeIndex(w http.ResponseWriter, r *http.Request, idx v1.ImageIndex, also ...string) error {
-	ctx := r.Context()
+const defaultSignedURLExpiry = 15 * time.Minute
+
+// WriteIndex writes manifest, config and layer blobs for each image in the
+// index, then writes the index manifest contents pointing to those blobs. If
+// the index has a subject, it's listed among the subject's referrers.
+func WriteIndex(ctx context.Context, st Storage, idx v1.ImageIndex, also ...string) error {
 	im, err := idx.IndexManifest()
 	if err != nil {
 		return err
@@ -131,7 +169,7 @@ func (s *Storage) ServeIndex(w http.ResponseWriter, r *http.Request, idx v1.Imag
 			if err != nil {
 				return err
 			}
-			return s.WriteImage(ctx, img)
+			return WriteImage(ctx, st, img)
 		})
 	}
 	if err := g.Wait(); err != nil {
@@ -151,39 +189,24 @@ func (s *Storage) ServeIndex(w http.ResponseWriter, r *http.Request, idx v1.Imag
 	if err != nil {
 		return err
 	}
-	if err := s.writeBlob(ctx, digest.String(), digest, io.NopCloser(bytes.NewReader(b)), string(mt)); err != nil {
+	if err := st.writeBlob(ctx, digest.String(), digest, int64(len(b)), io.NopCloser(bytes.NewReader(b)), string(mt)); err != nil {
 		return err
 	}
-
+	if _, err := indexReferrer(ctx, st, v1.Descriptor{MediaType: mt, Digest: digest, Size: int64(len(b))}, b); err != nil {
+		return fmt.Errorf("indexing referrer: %w", err)
+	}
 	for _, a := range also {
 		a := a
 		g.Go(func() error {
-			return s.writeBlob(ctx, a, digest, io.NopCloser(bytes.NewReader(b)), string(mt))
+			return st.writeBlob(ctx, a, digest, int64(len(b)), io.NopCloser(bytes.NewReader(b)), string(mt))
 		})
 	}
-	if err := g.Wait(); err != nil {
-		return err
-	}
-
-	// If it's just a HEAD request, serve that.
-	if r.Method == http.MethodHead {
-		s, err := idx.Size()
-		if err != nil {
-			return err
-		}
-		w.Header().Set("Docker-Content-Digest", digest.String())
-		w.Header().Set("Content-Type", string(mt))
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", s))
-		return nil
-	}
-
-	// Redirect to manifest blob.
-	Blob(w, r, digest.String())
-	return nil
+	return g.Wait()
 }
 
-// WriteImage writes the layer blobs, config blob and manifest.
-func (s *Storage) WriteImage(ctx context.Context, img v1.Image, also ...string) error {
+// WriteImage writes the layer blobs, config blob and manifest. If the
+// manifest has a subject, it's listed among the subject's referrers.
+func WriteImage(ctx context.Context, st Storage, img v1.Image, also ...string) error {
 	// Write config blob for later serving.
 	ch, err := img.ConfigName()
 	if err != nil {
@@ -193,37 +216,57 @@ func (s *Storage) WriteImage(ctx context.Context, img v1.Image, also ...string)
 	if err != nil {
 		return err
 	}
-	if err := s.writeBlob(ctx, ch.String(), ch, io.NopCloser(bytes.NewReader(cb)), "application/json"); err != nil {
+	if err := st.writeBlob(ctx, ch.String(), ch, int64(len(cb)), io.NopCloser(bytes.NewReader(cb)), "application/json"); err != nil {
 		return err
 	}
 
-	// Write layer blobs for later serving.
+	// Write layer blobs for later serving, skipping any that are already
+	// stored without opening them.
 	layers, err := img.Layers()
 	if err != nil {
 		return err
 	}
+	m, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	if len(m.Layers) != len(layers) {
+		return fmt.Errorf("manifest has %d layers, image has %d", len(m.Layers), len(layers))
+	}
+	digests := make([]v1.Hash, 0, len(m.Layers))
+	for _, d := range m.Layers {
+		digests = append(digests, d.Digest)
+	}
+	missing := missingBlobs(ctx, st, digests)
+
 	var g errgroup.Group
-	for _, l := range layers {
-		l := l
+	var skipped int
+	var skippedBytes int64
+	for i, l := range layers {
+		d, l := m.Layers[i], l
+		if !missing[d.Digest] {
+			skipped++
+			skippedBytes += d.Size
+			continue
+		}
 		g.Go(func() error {
 			rc, err := l.Compressed()
 			if err != nil {
 				return err
 			}
-			lh, err := l.Digest()
-			if err != nil {
-				return err
-			}
-			mt, err := l.MediaType()
-			if err != nil {
+			start := time.Now()
+			if err := st.writeBlob(ctx, d.Digest.String(), d.Digest, d.Size, rc, string(d.MediaType)); err != nil {
 				return err
 			}
-			return s.writeBlob(ctx, lh.String(), lh, rc, string(mt))
+			known.observeWrite(d.Size, time.Since(start))
+			known.add(d.Digest)
+			return nil
 		})
 	}
 	if err := g.Wait(); err != nil {
 		return err
 	}
+	reportSkipped(ctx, skipped, skippedBytes)
 
 	// Write the manifest as a blob.
 	b, err := img.RawManifest()
@@ -238,48 +281,17 @@ func (s *Storage) WriteImage(ctx context.Context, img v1.Image, also ...string)
 	if err != nil {
 		return err
 	}
-	if err := s.writeBlob(ctx, digest.String(), digest, io.NopCloser(bytes.NewReader(b)), string(mt)); err != nil {
+	if err := st.writeBlob(ctx, digest.String(), digest, int64(len(b)), io.NopCloser(bytes.NewReader(b)), string(mt)); err != nil {
 		return err
 	}
+	if _, err := indexReferrer(ctx, st, v1.Descriptor{MediaType: mt, Digest: digest, Size: int64(len(b))}, b); err != nil {
+		return fmt.Errorf("indexing referrer: %w", err)
+	}
 	for _, a := range also {
 		a := a
 		g.Go(func() error {
-			return s.writeBlob(ctx, a, digest, io.NopCloser(bytes.NewReader(b)), string(mt))
+			return st.writeBlob(ctx, a, digest, int64(len(b)), io.NopCloser(bytes.NewReader(b)), string(mt))
 		})
 	}
 	return g.Wait()
 }
-
-// ServeManifest writes config and layer blobs for the image, then writes and
-// redirects to the image manifest contents pointing to those blobs.
-func (s *Storage) ServeManifest(w http.ResponseWriter, r *http.Request, img v1.Image, also ...string) error {
-	ctx := r.Context()
-	if err := s.WriteImage(ctx, img, also...); err != nil {
-		return err
-	}
-
-	digest, err := img.Digest()
-	if err != nil {
-		return err
-	}
-
-	// If it's just a HEAD request, serve that.
-	if r.Method == http.MethodHead {
-		mt, err := img.MediaType()
-		if err != nil {
-			return err
-		}
-		s, err := img.Size()
-		if err != nil {
-			return err
-		}
-		w.Header().Set("Docker-Content-Digest", digest.String())
-		w.Header().Set("Content-Type", string(mt))
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", s))
-		return nil
-	}
-
-	// Redirect to manifest blob.
-	Blob(w, r, digest.String())
-	return nil
-}
@@ -0,0 +1,84 @@
+// Package servetest runs services and the registries they pull from
+// in-process, so they can be tested without network or GCP access.
+package servetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// Serve serves h until the test ends, and returns the host to pull from it.
+func Serve(t testing.TB, h http.Handler) string {
+	t.Helper()
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// UpstreamHost is the host of the registry started by Upstream.
+//
+// It's a name that the test server's certificate is valid for, so that
+// services pull from it over TLS like any other registry.
+const UpstreamHost = "example.com"
+
+// Upstream starts an in-process registry that serves requests for
+// UpstreamHost until the test ends, for services to pull images from and for
+// tests to push them to. It returns the transport that routes requests for
+// UpstreamHost to it, to pass to services and to remote.WithTransport, so that
+// tests using separate registries can run in parallel.
+func Upstream(t testing.TB) http.RoundTripper {
+	t.Helper()
+	s := httptest.NewTLSServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(s.Close)
+
+	tr := s.Client().Transport.(*http.Transport).Clone()
+	var d net.Dialer
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == UpstreamHost+":443" {
+			addr = s.Listener.Addr().String()
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+	return tr
+}
+
+// DeleteUpstreamBlob deletes the blob from the repository in the registry
+// started by Upstream, reached through its transport tr, like a registry
+// garbage collecting it, so tests can check that it's no longer needed.
+func DeleteUpstreamBlob(t testing.TB, tr http.RoundTripper, repo string, d v1.Hash) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("https://%s/v2/%s/blobs/%s", UpstreamHost, repo, d), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("deleting upstream blob: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("deleting upstream blob: got status %d", resp.StatusCode)
+	}
+}
+
+// ErrorCode returns the code of the first registry error in err, or the
+// empty string if there isn't one.
+func ErrorCode(err error) transport.ErrorCode {
+	var terr *transport.Error
+	if !errors.As(err, &terr) || len(terr.Errors) == 0 {
+		return ""
+	}
+	return terr.Errors[0].Code
+}
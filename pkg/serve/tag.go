@@ -0,0 +1,184 @@
+package serve
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// WriteTag stores a copy of the manifest described by desc under name,
+// replacing whatever was stored there before, so that it can be served by
+// name. If expires is non-zero, LookupTag stops finding the tag after that
+// time, and CollectGarbage deletes it.
+func WriteTag(ctx context.Context, st Storage, name string, desc v1.Descriptor, expires time.Time) error {
+	rc, err := st.readBlob(ctx, desc.Digest.String())
+	if err != nil {
+		return fmt.Errorf("reading manifest %s: %w", desc.Digest, err)
+	}
+	if _, err := st.BlobExists(ctx, name); err == nil {
+		if err := st.delete(ctx, name); err != nil {
+			rc.Close()
+			return fmt.Errorf("deleting previous tag %q: %w", name, err)
+		}
+	}
+	if err := st.writeBlob(ctx, name, desc.Digest, desc.Size, rc, string(desc.MediaType)); err != nil {
+		return err
+	}
+	if expires.IsZero() {
+		return nil
+	}
+	return st.setExpiry(ctx, name, expires)
+}
+
+// LookupTag returns a descriptor for the manifest stored under name by
+// WriteTag. If there is none, or it has expired, it returns an error that's
+// served as MANIFEST_UNKNOWN.
+func LookupTag(ctx context.Context, st Storage, name string) (v1.Descriptor, error) {
+	o, err := st.stat(ctx, name)
+	if err != nil {
+		slog.InfoContext(ctx, "stat", "name", name, "err", err)
+		return v1.Descriptor{}, Errorf(ManifestUnknown, "tag not found")
+	}
+	if !o.Expires.IsZero() && time.Now().After(o.Expires) {
+		return v1.Descriptor{}, Errorf(ManifestUnknown, "tag expired at %s", o.Expires.UTC().Format(time.RFC3339))
+	}
+	return o.Descriptor, nil
+}
+
+// Each tag recorded by RecordTag is an object named
+// "tags-<service>-<repo>-<tag>", where the repo name is hashed since it can
+// contain slashes. Services share storage, so the same repo name in two
+// services has different tags.
+func tagsPrefix(service, repo string) string {
+	return fmt.Sprintf("tags-%s-%x-", service, md5.Sum([]byte(repo)))
+}
+
+// RecordTag records that tag has been served from repo by the service, so
+// that it's listed by RecordedTags. If expires is non-zero, the tag isn't
+// listed after that time. Otherwise, the record expires with age, like other
+// objects written by WriteObject.
+func RecordTag(ctx context.Context, st Storage, service, repo, tag string, expires time.Time) error {
+	name := tagsPrefix(service, repo) + tag
+	if err := st.WriteObject(ctx, name, tag); err != nil {
+		return err
+	}
+	if expires.IsZero() {
+		return nil
+	}
+	return st.setExpiry(ctx, name, expires)
+}
+
+// RecordedTags returns the unexpired tags recorded for repo in the service by
+// RecordTag.
+func RecordedTags(ctx context.Context, st Storage, service, repo string) ([]string, error) {
+	prefix := tagsPrefix(service, repo)
+	objs, err := st.list(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tags := make([]string, 0, len(objs))
+	for _, o := range objs {
+		if !o.Expires.IsZero() && now.After(o.Expires) {
+			continue
+		}
+		tags = append(tags, strings.TrimPrefix(o.Name, prefix))
+	}
+	return tags, nil
+}
+
+// tagList is the response to a tags/list request.
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// serveTags serves the tags in repo listed by ListTags, paginated by
+// paginate.
+func (rt *Router) serveTags(w http.ResponseWriter, r *http.Request, repo string) {
+	ctx := r.Context()
+	if rt.ListTags == nil {
+		Error(w, Errorf(Unsupported, "listing tags is not supported"))
+		return
+	}
+	tags, err := rt.ListTags(ctx, repo)
+	if err != nil {
+		slog.ErrorContext(ctx, "ListTags", "repo", repo, "err", err)
+		Error(w, err)
+		return
+	}
+	tags, err = paginate(w, r, tags)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	serveJSON(w, r, tagList{Name: repo, Tags: tags})
+}
+
+// paginate sorts and deduplicates items, and returns the page of them
+// requested by the n and last query parameters: at most n items, after last.
+// If there are more, it sets the Link header to the next page.
+func paginate(w http.ResponseWriter, r *http.Request, items []string) ([]string, error) {
+	q := r.URL.Query()
+	n := -1
+	if v := q.Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			return nil, Errorf(PaginationNumberInvalid, "invalid number of results %q", v)
+		}
+	}
+	last := q.Get("last")
+
+	items = slices.Clone(items)
+	sort.Strings(items)
+	items = slices.Compact(items)
+	if last != "" {
+		i, _ := slices.BinarySearch(items, last)
+		for i < len(items) && items[i] <= last {
+			i++
+		}
+		items = items[i:]
+	}
+	if n >= 0 && len(items) > n {
+		items = items[:n]
+		if n > 0 {
+			// Link to the path the client requested, which differs from
+			// r.URL.Path if a prefix was stripped before routing.
+			path, _, _ := strings.Cut(r.RequestURI, "?")
+			if path == "" {
+				path = r.URL.Path
+			}
+			// Keep any other parameters, like filters.
+			next := r.URL.Query()
+			next.Set("n", strconv.Itoa(n))
+			next.Set("last", items[n-1])
+			w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, path, next.Encode()))
+		}
+	}
+	return items, nil
+}
+
+// serveJSON serves v as JSON.
+func serveJSON(w http.ResponseWriter, r *http.Request, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(b)
+}
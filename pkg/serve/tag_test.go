@@ -0,0 +1,47 @@
+package serve
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRecordedTags(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+	for _, r := range []struct {
+		service, repo, tag string
+		expires            time.Time
+	}{
+		{"apko", "foo", "latest", time.Time{}},
+		{"apko", "foo", "old", time.Now().Add(-time.Minute)},
+		{"apko", "foo/bar", "nested", time.Time{}},
+		{"flatten", "foo", "flattened", time.Time{}},
+		{"ttl", "foo", "1h", time.Now().Add(time.Hour)},
+	} {
+		if err := RecordTag(ctx, st, r.service, r.repo, r.tag, r.expires); err != nil {
+			t.Fatalf("RecordTag(%s, %s, %s): %v", r.service, r.repo, r.tag, err)
+		}
+	}
+
+	for _, c := range []struct {
+		service, repo string
+		want          []string
+	}{
+		{"apko", "foo", []string{"latest"}},
+		{"apko", "foo/bar", []string{"nested"}},
+		{"flatten", "foo", []string{"flattened"}},
+		{"ttl", "foo", []string{"1h"}},
+		{"mirror", "foo", []string{}},
+	} {
+		got, err := RecordedTags(ctx, st, c.service, c.repo)
+		if err != nil {
+			t.Fatalf("RecordedTags(%s, %s): %v", c.service, c.repo, err)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, c.want) {
+			t.Errorf("RecordedTags(%s, %s): got %v, want %v", c.service, c.repo, got, c.want)
+		}
+	}
+}
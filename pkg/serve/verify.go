@@ -0,0 +1,168 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrIncompleteManifest is returned by VerifyManifest when a stored manifest
+// references blobs that are missing from Storage.
+var ErrIncompleteManifest = errors.New("manifest references missing blobs")
+
+// VerifyManifest checks that the named manifest blob exists, along with every
+// manifest, config and layer blob it references. Commands should call it on
+// cache hits before serving a cached manifest, so that pulls never fail
+// partway through with BLOB_UNKNOWN.
+//
+// If any referenced blob is missing, the named blob is deleted so that it can
+// be rewritten by a rebuild, and an error wrapping ErrIncompleteManifest is
+// returned. Callers should treat this as a cache miss. Other errors, like
+// transient storage errors or a cancelled context, are returned without
+// deleting anything.
+//
+// Successful verifications are remembered in memory for $VERIFY_CACHE_TTL
+// (default 10m). If $VERIFY_SAMPLE_RATE is set to a value between 0 and 1,
+// only that fraction of cache hits are verified; the rest are assumed to be
+// complete.
+func VerifyManifest(ctx context.Context, st Storage, name string) error {
+	desc, err := st.BlobExists(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !isManifest(desc.MediaType) || desc.Digest == (v1.Hash{}) {
+		return fmt.Errorf("%q is not a manifest (%s)", name, desc.MediaType)
+	}
+
+	cfg := loadVerifyConfig()
+	if verified.get(name, desc.Digest) {
+		return nil
+	}
+	if cfg.sampleRate < 1 && rand.Float64() >= cfg.sampleRate {
+		return nil
+	}
+
+	if err := verifyRefs(ctx, st, desc); err != nil {
+		if !isNotExist(err) {
+			return fmt.Errorf("verifying %q: %w", name, err)
+		}
+		slog.WarnContext(ctx, "cached manifest is incomplete; deleting", "name", name, "digest", desc.Digest, "err", err)
+		if err := st.delete(ctx, name); err != nil {
+			return fmt.Errorf("deleting incomplete manifest %q: %w", name, err)
+		}
+		return fmt.Errorf("%w: %w", ErrIncompleteManifest, err)
+	}
+	verified.put(name, desc.Digest, cfg.ttl)
+	return nil
+}
+
+// verifyRefs checks that every blob referenced by the manifest described by
+// desc exists, recursing into child manifests of an index.
+func verifyRefs(ctx context.Context, st Storage, desc v1.Descriptor) error {
+	refs, err := manifestRefs(ctx, st, desc.Digest.String(), desc.MediaType)
+	if err != nil {
+		return fmt.Errorf("reading manifest %s: %w", desc.Digest, err)
+	}
+	var g errgroup.Group
+	g.SetLimit(10)
+	for _, h := range refs {
+		h := h
+		g.Go(func() error {
+			d, err := st.BlobExists(ctx, h.String())
+			if err != nil {
+				if isNotExist(err) {
+					known.forget(h)
+				}
+				return fmt.Errorf("blob %s: %w", h, err)
+			}
+			if !isManifest(d.MediaType) {
+				return nil
+			}
+			d.Digest = h
+			return verifyRefs(ctx, st, d)
+		})
+	}
+	return g.Wait()
+}
+
+type verifyConfig struct {
+	ttl        time.Duration
+	sampleRate float64
+}
+
+const defaultVerifyCacheTTL = 10 * time.Minute
+
+var loadVerifyConfig = sync.OnceValue(func() verifyConfig {
+	cfg := verifyConfig{ttl: defaultVerifyCacheTTL, sampleRate: 1}
+	if e := os.Getenv("VERIFY_CACHE_TTL"); e != "" {
+		if d, err := time.ParseDuration(e); err == nil {
+			cfg.ttl = d
+		} else {
+			slog.Warn("parsing $VERIFY_CACHE_TTL", "err", err)
+		}
+	}
+	if e := os.Getenv("VERIFY_SAMPLE_RATE"); e != "" {
+		if f, err := strconv.ParseFloat(e, 64); err == nil && f >= 0 && f <= 1 {
+			cfg.sampleRate = f
+		} else {
+			slog.Warn("invalid $VERIFY_SAMPLE_RATE; verifying every cache hit", "value", e)
+		}
+	}
+	return cfg
+})
+
+// verified remembers which manifests have recently been verified, keyed by
+// name, along with the digest they pointed to at the time.
+var verified = &verifyCache{entries: map[string]verifyEntry{}}
+
+type verifyCache struct {
+	mu      sync.Mutex
+	entries map[string]verifyEntry
+}
+
+type verifyEntry struct {
+	digest  v1.Hash
+	expires time.Time
+}
+
+func (c *verifyCache) get(name string, h v1.Hash) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return false
+	}
+	if e.digest != h || time.Now().After(e.expires) {
+		delete(c.entries, name)
+		return false
+	}
+	return true
+}
+
+func (c *verifyCache) put(name string, h v1.Hash, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// Sweep expired entries occasionally so the map doesn't grow without
+	// bound.
+	if len(c.entries) > 10000 {
+		for n, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, n)
+			}
+		}
+	}
+	c.entries[name] = verifyEntry{digest: h, expires: now.Add(ttl)}
+}
@@ -0,0 +1,81 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+// failingStorage returns err when checking whether the named blob exists.
+type failingStorage struct {
+	Storage
+	name string
+	err  error
+}
+
+func (s failingStorage) BlobExists(ctx context.Context, name string) (v1.Descriptor, error) {
+	if name == s.name {
+		return v1.Descriptor{}, s.err
+	}
+	return s.Storage.BlobExists(ctx, name)
+}
+
+func TestVerifyManifest(t *testing.T) {
+	for _, c := range []struct {
+		desc           string
+		err            error
+		wantIncomplete bool
+	}{{
+		desc: "complete",
+	}, {
+		desc:           "missing blob",
+		err:            fmt.Errorf("stat: %w", fs.ErrNotExist),
+		wantIncomplete: true,
+	}, {
+		desc:           "missing GCS object",
+		err:            storage.ErrObjectNotExist,
+		wantIncomplete: true,
+	}, {
+		desc: "transient error",
+		err:  errors.New("googleapi: Error 503: backend error"),
+	}, {
+		desc: "cancelled context",
+		err:  context.Canceled,
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			mem := NewMemoryStorage()
+			img, err := random.Image(100, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ck := "verify-" + c.desc
+			if err := WriteImage(ctx, mem, img, ck); err != nil {
+				t.Fatal(err)
+			}
+			var st Storage = mem
+			if c.err != nil {
+				st = failingStorage{Storage: mem, name: imageNames(t, img)["layer"], err: c.err}
+			}
+
+			err = VerifyManifest(ctx, st, ck)
+			if got := errors.Is(err, ErrIncompleteManifest); got != c.wantIncomplete {
+				t.Errorf("VerifyManifest: got %v, want incomplete %t", err, c.wantIncomplete)
+			}
+			if c.err != nil && err == nil {
+				t.Error("VerifyManifest: got nil error")
+			}
+			// The cache key is only deleted if a blob is really missing.
+			_, serr := mem.BlobExists(ctx, ck)
+			if deleted := serr != nil; deleted != c.wantIncomplete {
+				t.Errorf("cache key deleted: got %t, want %t", deleted, c.wantIncomplete)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package ttl
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+// DefaultMaxTTL is the longest a pushed image is kept, unless $MAX_TTL says
+// otherwise. Expired tags, and the blobs only they referenced, are deleted by
+// the garbage collector.
+const DefaultMaxTTL = 7 * 24 * time.Hour
+
+// MaxTTL returns the maximum TTL set by $MAX_TTL, like 12h or 30d, or
+// DefaultMaxTTL if it's not set.
+func MaxTTL() (time.Duration, error) {
+	m := os.Getenv("MAX_TTL")
+	if m == "" {
+		return DefaultMaxTTL, nil
+	}
+	d, err := parseTTL(m)
+	if err != nil {
+		return 0, fmt.Errorf("parsing $MAX_TTL: %w", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("$MAX_TTL must be positive, got %q", m)
+	}
+	return d, nil
+}
+
+// New returns a registry that accepts pushes of any image, and serves each
+// tag until the duration it names has passed, up to maxTTL. Images are stored
+// in st.
+func New(st serve.Storage, maxTTL time.Duration) http.Handler {
+	s := &server{storage: st, maxTTL: maxTTL}
+	return &serve.Router{
+		Storage:         st,
+		Service:         service,
+		ResolveManifest: s.resolveManifest,
+		PushManifest:    s.pushManifest,
+		ListTags:        s.listTags,
+		Fallback:        http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/ttl", http.StatusSeeOther),
+	}
+}
+
+// service labels metrics recorded by this service.
+const service = "ttl"
+
+type server struct {
+	storage serve.Storage
+	maxTTL  time.Duration
+}
+
+func tagName(repo, tag string) string {
+	return fmt.Sprintf("ttl-%x", md5.Sum([]byte(repo+":"+tag)))
+}
+
+// ttl.kontain.me/(name):1h -> serve the image pushed to that tag, until an
+// hour after it was pushed.
+func (s *server) resolveManifest(ctx context.Context, repo, tag string) (string, error) {
+	name := tagName(repo, tag)
+	_, err := serve.LookupTag(ctx, s.storage, name)
+	serve.RecordCacheLookup(service, err == nil)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// pushManifest records the tag a manifest was pushed to, and when it
+// expires. Manifests pushed by digest are kept like any other blob, as long
+// as they're young or referenced by an unexpired tag.
+func (s *server) pushManifest(ctx context.Context, repo, ref string, desc v1.Descriptor) error {
+	if strings.Contains(ref, ":") {
+		return nil
+	}
+	ttl, err := parseTTL(ref)
+	if err != nil {
+		// Tags that aren't durations, like latest, get the longest TTL.
+		ttl = s.maxTTL
+	}
+	if ttl <= 0 || ttl > s.maxTTL {
+		return serve.Errorf(serve.TagInvalid, "tag %q must be a duration up to %s", ref, s.maxTTL)
+	}
+	expires := time.Now().Add(ttl)
+	slog.InfoContext(ctx, "tagging pushed manifest", "repo", repo, "tag", ref, "digest", desc.Digest, "expires", expires)
+	if err := serve.WriteTag(ctx, s.storage, tagName(repo, ref), desc, expires); err != nil {
+		return err
+	}
+	return serve.RecordTag(ctx, s.storage, service, repo, ref, expires)
+}
+
+// listTags lists the unexpired tags pushed to the repository.
+func (s *server) listTags(ctx context.Context, repo string) ([]string, error) {
+	return serve.RecordedTags(ctx, s.storage, service, repo)
+}
+
+// parseTTL parses a duration like 30m or 1h, or a number of days like 2d.
+func parseTTL(s string) (time.Duration, error) {
+	if d, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(d)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,99 @@
+package ttl
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"github.com/imjasonh/kontain.me/pkg/serve/servetest"
+)
+
+func TestParseTTL(t *testing.T) {
+	t.Parallel()
+	for _, c := range []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "30m", want: 30 * time.Minute},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "2d", want: 48 * time.Hour},
+		{in: "0d", want: 0},
+		{in: "latest", wantErr: true},
+		{in: "d", wantErr: true},
+		{in: "1.5d", wantErr: true},
+	} {
+		got, err := parseTTL(c.in)
+		if (err != nil) != c.wantErr || got != c.want {
+			t.Errorf("parseTTL(%q): got %s, %v; want %s, error %t", c.in, got, err, c.want, c.wantErr)
+		}
+	}
+}
+
+func TestPush(t *testing.T) {
+	t.Parallel()
+	h := New(serve.NewMemoryStorage(), DefaultMaxTTL)
+	// Serve the registry under a prefix, like kontain does, to check that
+	// pushes are told to continue under it.
+	host := servetest.Serve(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/v2/ttl/"); ok {
+			r.URL.Path = "/v2/" + rest
+		} else if r.URL.Path != "/v2/" {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	repo, err := name.NewRepository(host + "/ttl/my-ci-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		tag      string
+		wantCode string
+	}{
+		{tag: "1h"},
+		{tag: "2d"},
+		{tag: "latest"},
+		{tag: "8d", wantCode: "TAG_INVALID"},
+		{tag: "0s", wantCode: "TAG_INVALID"},
+	} {
+		err := remote.Write(repo.Tag(c.tag), img)
+		if got := string(servetest.ErrorCode(err)); got != c.wantCode || (c.wantCode == "" && err != nil) {
+			t.Errorf("pushing %s: got %v, want %q", c.tag, err, c.wantCode)
+			continue
+		}
+		if c.wantCode != "" {
+			continue
+		}
+		desc, err := remote.Head(repo.Tag(c.tag))
+		if err != nil {
+			t.Errorf("remote.Head(%s): %v", c.tag, err)
+		} else if desc.Digest != d {
+			t.Errorf("remote.Head(%s): got digest %s, want %s", c.tag, desc.Digest, d)
+		}
+	}
+
+	tags, err := remote.List(repo)
+	if err != nil {
+		t.Fatalf("remote.List: %v", err)
+	}
+	if want := []string{"1h", "2d", "latest"}; !slices.Equal(tags, want) {
+		t.Errorf("remote.List: got %v, want %v", tags, want)
+	}
+}
@@ -0,0 +1,133 @@
+package wait
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/imjasonh/delay/pkg/delay"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+const queueName = "wait-queue"
+
+// New returns a registry that serves randomly-generated images after a delay,
+// writing them to st.
+func New(st serve.Storage) http.Handler {
+	s := &server{storage: st}
+	taskStorage.Store(&st)
+	return &serve.Router{
+		Storage:         st,
+		Service:         service,
+		ResolveManifest: s.resolveManifest,
+		ListTags:        s.listTags,
+		Fallback:        http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/wait", http.StatusSeeOther),
+	}
+}
+
+// service labels metrics recorded by this service.
+const service = "wait"
+
+type server struct{ storage serve.Storage }
+
+func cacheKey(name string) string {
+	ck := []byte(strings.ReplaceAll(name, "/", "_"))
+	return fmt.Sprintf("wait-%x", md5.Sum(ck))
+}
+
+// exampleTags are listed as the repository's tags, since any duration up
+// to an hour is served.
+var exampleTags = []string{"latest", "5s", "30s", "1m", "10m", "1h"}
+
+func (s *server) listTags(context.Context, string) ([]string, error) { return exampleTags, nil }
+
+// wait.kontain.me/(name):5s -> enqueue task to generate random manifest in 5s
+// - latest defaults to 10s
+// if manifest for name exists, serve it.
+// if a placeholder exists, a wait is ongoing.
+func (s *server) resolveManifest(ctx context.Context, name, tag string) (string, error) {
+	// The image has already been built; serve it.
+	ck := cacheKey(name)
+	err := serve.VerifyManifest(ctx, s.storage, ck)
+	serve.RecordCacheLookup(service, err == nil)
+	if err == nil {
+		slog.InfoContext(ctx, "blob exists", "ck", ck)
+		return ck, nil
+	}
+
+	// If a placeholder exists, a wait is ongoing; serve the placeholder
+	// contents. If the cached image was incomplete, the placeholder is
+	// stale, so generate a new image.
+	phn := fmt.Sprintf("placeholder-%s", ck)
+	if _, perr := s.storage.BlobExists(ctx, phn); perr == nil && !errors.Is(err, serve.ErrIncompleteManifest) {
+		slog.InfoContext(ctx, "placeholder exists", "phn", phn)
+		return "", serve.Retryable(serve.Unavailable, retryAfter, "waiting for image...")
+	}
+
+	// No cached image or placeholder exists; enqueue a new task.
+	if tag == "latest" {
+		tag = "10s"
+	}
+	dur, err := time.ParseDuration(tag)
+	if err != nil {
+		return "", serve.Errorf(serve.TagInvalid, "time.ParseDuration: %w", err)
+	}
+	if dur > time.Hour {
+		return "", serve.Errorf(serve.TagInvalid, "duration > 1h (%s)", dur)
+	}
+	// Only charge for starting a wait, not for polling one in progress.
+	if err := serve.ChargeBuild(ctx); err != nil {
+		return "", err
+	}
+	slog.InfoContext(ctx, "generating random image", "ck", ck, "dur", dur)
+
+	// Enqueue the task for later.
+	if err := laterFunc.Call(ctx, serve.RequestFromContext(ctx), queueName,
+		delay.WithArgs(ck, name, dur.String()),
+		delay.WithDelay(dur)); err != nil {
+		return "", fmt.Errorf("laterFunc.Call: %w", err)
+	}
+
+	// Write the placeholder object.
+	if err := s.storage.WriteObject(ctx, phn, fmt.Sprintf("serving image at %s", time.Now().Add(dur))); err != nil {
+		return "", fmt.Errorf("storage.WriteObject: %w", err)
+	}
+
+	return "", serve.Retryable(serve.Unavailable, dur, "enqueued task to generate image in %s", dur)
+}
+
+// retryAfter is how long clients are told to wait before retrying while an
+// image is being generated.
+const retryAfter = 5 * time.Second
+
+const size = 100
+const num = 10
+
+// taskStorage is the storage passed to New, which laterFunc writes images to.
+// It's set when the service is created, since tasks may run on any instance.
+var taskStorage atomic.Pointer[serve.Storage]
+
+var laterFunc = delay.Func("later", generate)
+
+// generate writes a random image to the storage passed to New, under the
+// cache key ck.
+func generate(ctx context.Context, ck, name, dur string) error {
+	st := taskStorage.Load()
+	if st == nil {
+		return errors.New("no storage to write images to; wait.New wasn't called")
+	}
+	log.Printf("generating random image for cache key %q", ck)
+	img, err := random.Image(size, num)
+	if err != nil {
+		return err
+	}
+	return serve.WriteImage(ctx, *st, img, ck)
+}
@@ -0,0 +1,89 @@
+package wait
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"github.com/imjasonh/kontain.me/pkg/serve/servetest"
+)
+
+// Enqueueing a task to generate an image needs Cloud Tasks, so these tests
+// only cover requests that are answered without one.
+func TestWait(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	st := serve.NewMemoryStorage()
+	host := servetest.Serve(t, New(st))
+
+	// An image that's already been generated is served by tag and by
+	// digest.
+	img, err := random.Image(size, num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serve.WriteImage(ctx, st, img, cacheKey("done")); err != nil {
+		t.Fatalf("serve.WriteImage: %v", err)
+	}
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := name.NewRepository(host + "/done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []name.Reference{repo.Tag("5s"), repo.Digest(d.String())} {
+		desc, err := remote.Head(ref)
+		if err != nil {
+			t.Fatalf("remote.Head(%s): %v", ref, err)
+		}
+		if desc.Digest != d {
+			t.Errorf("HEAD %s got digest %s, want %s", ref, desc.Digest, d)
+		}
+		got, err := remote.Image(ref)
+		if err != nil {
+			t.Fatalf("remote.Image(%s): %v", ref, err)
+		}
+		if err := validate.Image(got); err != nil {
+			t.Errorf("validate.Image(%s): %v", ref, err)
+		}
+	}
+
+	// While an image is being generated, clients are told to retry.
+	if err := st.WriteObject(ctx, "placeholder-"+cacheKey("waiting"), "serving image soon"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + host + "/v2/waiting/manifests/5s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("while waiting: got status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "5" {
+		t.Errorf("while waiting: got Retry-After %q, want %q", got, "5")
+	}
+
+	// Tags that aren't durations up to an hour are rejected.
+	for _, tag := range []string{"forever", "2h"} {
+		ref := repo.Registry.Repo("invalid").Tag(tag)
+		if _, err := remote.Image(ref); servetest.ErrorCode(err) != "TAG_INVALID" {
+			t.Errorf("remote.Image(%s): got %v, want TAG_INVALID", ref, err)
+		}
+	}
+
+	// Tasks write the image to the service's storage.
+	if err := generate(ctx, cacheKey("later"), "later", "5s"); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if err := serve.VerifyManifest(ctx, st, cacheKey("later")); err != nil {
+		t.Errorf("after generate: %v", err)
+	}
+}